@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/majestrate/ubw/lib/attachments"
+	"github.com/majestrate/ubw/lib/client"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"github.com/majestrate/ubw/lib/swarm"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"os"
+	"strings"
+)
+
+/// config is the archer config file, all fields are optional
+type config struct {
+	/// SeedNodes is a list of host:port or ed25519pubkey@host:port seed nodes
+	SeedNodes []string `json:"seed_nodes"`
+	/// OnionRequests routes storage requests through onion paths
+	OnionRequests bool `json:"onion_requests"`
+	/// InsecureSkipVerify allows seed nodes given by ip without an identity key
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	/// PinIdentities checks service node certificates against their identity keys, for networks whose nodes sign their certificates
+	PinIdentities bool `json:"pin_identities"`
+	/// Database is a sqlite file name or a postgres:// dsn, defaults to messages.db
+	Database string `json:"database"`
+	/// EncryptDatabase seals stored messages and history with a key from our seed, or from $UBW_DB_PASSPHRASE if it is set
+	EncryptDatabase bool `json:"encrypt_database"`
+	/// FileServer is a base url attachments are uploaded to and fetched from instead of the host in each attachment's url
+	FileServer string `json:"file_server"`
+	/// AttachmentHosts replaces the hosts attachment urls may point at when there is no FileServer
+	AttachmentHosts []string `json:"attachment_hosts"`
+	/// AnyAttachmentHost fetches attachment urls from any https host when there is no FileServer
+	AnyAttachmentHost bool `json:"any_attachment_host"`
+}
+
+/// passphraseEnv names the environment variable holding the database passphrase
+const passphraseEnv = "UBW_DB_PASSPHRASE"
+
+var configFile = flag.String("config", "", "path to a json config file")
+var databaseFlag = flag.String("db", "", "sqlite file or postgres:// dsn to keep messages in, overrides the config file")
+var seedNodesFlag = flag.String("seeds", "", "comma separated list of seed nodes to bootstrap from, overrides $"+swarm.SeedNodesEnv+" and the config file")
+
+func loadConfig(fname string) (*config, error) {
+	conf := new(config)
+	if fname == "" {
+		return conf, nil
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(conf)
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+const defaultDatabase = "messages.db"
+
+/// openStore opens the message store, sealing it if the config asks for an encrypted database
+func (conf *config) openStore(keys *cryptography.KeyPair) (client.MessageStore, error) {
+	store, err := conf.openDatabase()
+	if err != nil || !conf.EncryptDatabase {
+		return store, err
+	}
+	key := keys.StorageKey()
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		key = keys.PassphraseKey(passphrase)
+	}
+	sealed, err := client.SealedStore(store, key)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("could not seal database: %w", err)
+	}
+	return sealed, nil
+}
+
+/// openDatabase opens the message store named by the -db flag or the config file, dsns starting with postgres:// or postgresql:// use postgres and anything else is a sqlite file
+func (conf *config) openDatabase() (client.MessageStore, error) {
+	dsn := conf.Database
+	if *databaseFlag != "" {
+		dsn = *databaseFlag
+	}
+	if dsn == "" {
+		dsn = defaultDatabase
+	}
+	driver, open := "sqlite3", client.SQLStore
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		driver, open = "postgres", client.PostgresStore
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	store, err := open(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not open database: %w", err)
+	}
+	return store, nil
+}
+
+/// clientOptions builds the client options from the config file and command line flags
+/// seed nodes come from the -seeds flag, then $UBW_SEED_NODES, then the config file, the first that is set wins
+func (conf *config) clientOptions() (*client.ClientOptions, error) {
+	opts := new(client.ClientOptions)
+	seeds := *seedNodesFlag
+	if seeds == "" {
+		seeds = os.Getenv(swarm.SeedNodesEnv)
+	}
+	if seeds == "" {
+		seeds = strings.Join(conf.SeedNodes, ",")
+	}
+	nodes, err := swarm.ParseSeedNodes(seeds)
+	if err != nil {
+		return nil, err
+	}
+	opts.SeedNodes = nodes
+	opts.OnionRequests = conf.OnionRequests
+	opts.InsecureSkipVerify = conf.InsecureSkipVerify
+	opts.PinIdentities = conf.PinIdentities
+	files := &attachments.HTTPFileServer{AllowedHosts: conf.AttachmentHosts, AllowAnyHost: conf.AnyAttachmentHost}
+	if conf.FileServer != "" {
+		files.Base, err = url.Parse(conf.FileServer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts.FileServer = files
+	return opts, nil
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"flag"
 	"fmt"
 	"github.com/majestrate/ubw/lib/client"
 	"github.com/majestrate/ubw/lib/cryptography"
 	"github.com/majestrate/ubw/lib/model"
 	"github.com/majestrate/ubw/lib/version"
-	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"os/exec"
-	"time"
+	"os/signal"
+	"syscall"
 )
 
 // unlimited bot works
@@ -75,6 +76,11 @@ const gilgameshBanner = `UNLIMITED BOT WORKS [%s]
 const keyfile = "seed.dat"
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [handler [args...]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
 	if os.Getenv("ANNOYING_SHITASS_BANNER") != "NO" {
 		fmt.Printf(gilgameshBanner, version.Version)
@@ -91,24 +97,36 @@ func main() {
 		fmt.Printf("could not load %s: %s\n", keyfile, err.Error())
 		return
 	}
-	c, err := sql.Open("sqlite3", "messages.db")
+	conf, err := loadConfig(*configFile)
 	if err != nil {
-		fmt.Printf("could not open database: %s", err.Error())
+		fmt.Printf("could not load config: %s\n", err.Error())
+		return
+	}
+	opts, err := conf.clientOptions()
+	if err != nil {
+		fmt.Printf("bad config: %s\n", err.Error())
+		return
+	}
+	store, err := conf.openStore(keys)
+	if err != nil {
+		fmt.Printf("could not open database: %s\n", err.Error())
 		return
 	}
-	store := client.SQLStore(c)
 	defer store.Close()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	makeReply := func(msg *model.PlainMessage) *string {
 		return msg.Body()
 	}
-	if len(os.Args) >= 2 {
-		exe := os.Args[1]
-		args := os.Args[2:]
+	if flag.NArg() >= 1 {
+		exe := flag.Arg(0)
+		args := flag.Args()[1:]
 		makeReply = func(msg *model.PlainMessage) *string {
 			var ret string
-			cmd := exec.Command(exe, args...)
-			cmd.Env = append(os.Environ(), fmt.Sprintf("SESSION_ID=%s", msg.From), fmt.Sprintf("SESSION_MESSAGE=%s", msg.Body()))
+			cmd := exec.CommandContext(ctx, exe, args...)
+			cmd.Env = append(os.Environ(), fmt.Sprintf("SESSION_ID=%s", msg.From), fmt.Sprintf("SESSION_MESSAGE=%s", *msg.Body()))
 			data, err := cmd.Output()
 			if err == nil {
 				ret = string(data)
@@ -119,41 +137,38 @@ func main() {
 		}
 	}
 
-	me := client.NewClient(keys, store)
+	me := client.NewClient(keys, store, opts)
 	fmt.Printf("we are %s\n", me.SessionID())
-	baseDelay := 5 * time.Second
-	delay := baseDelay
-	for {
-		me.Update()
-		msgs, err := me.FetchNewMessages()
-		if err != nil {
-			fmt.Printf("fetch failed: %s\n", err.Error())
-			delay += 5 * time.Second
-			time.Sleep(delay)
-			continue
+	go me.RunUpdates(ctx, func(err error) {
+		fmt.Printf("snode list update failed: %s\n", err.Error())
+	})
+	go me.RunJanitor(ctx, func(err error) {
+		fmt.Printf("pruning old messages failed: %s\n", err.Error())
+	})
+	go me.RunOutbox(ctx, func(d client.Delivery) {
+		if d.Err != nil {
+			fmt.Printf("gave up sending to %s after %d attempts: %s\n", d.Message.To, d.Message.Attempts, d.Err.Error())
 		}
-		if len(msgs) > 0 {
-			fmt.Printf("got %d new messages\n", len(msgs))
+	})
+	me.Run(ctx, func(plain *model.PlainMessage) {
+		if plain.Body() == nil {
+			return
 		}
-		for _, msg := range msgs {
-			plain, err := me.DecryptMessage(msg)
-			if err != nil {
-				fmt.Printf("decrypt failed: %s\n", err.Error())
-				continue
-			}
-			if plain.Body() == nil {
-				continue
-			}
-			reply := makeReply(plain)
-			if reply == nil {
-				continue
-			}
-			err = me.SendTo(plain.From, *reply)
-			if err != nil {
-				fmt.Printf("sendto failed: %s\n", err.Error())
-			}
+		reply := makeReply(plain)
+		if reply == nil {
+			return
 		}
-		delay = baseDelay
-		time.Sleep(delay)
-	}
+		_, err := me.QueueReply(plain, *reply)
+		if err != nil {
+			fmt.Printf("could not queue reply: %s\n", err.Error())
+		}
+	}, func(ev client.Event) {
+		switch ev.Kind {
+		case client.EventError:
+			fmt.Printf("receive failed: %s\n", ev.Err.Error())
+		case client.EventSwarmChanged:
+			fmt.Printf("our swarm moved to %d nodes\n", len(ev.Swarm))
+		}
+	})
+	fmt.Println("shutting down")
 }
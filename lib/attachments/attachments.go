@@ -0,0 +1,281 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/majestrate/ubw/lib/protobuf"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+)
+
+var ErrBadKey = errors.New("attachment key is not 64 bytes")
+var ErrBadDigest = errors.New("attachment digest mismatch")
+var ErrBadMAC = errors.New("attachment mac mismatch")
+var ErrMalformed = errors.New("malformed attachment")
+var ErrTooLarge = errors.New("attachment too large")
+var ErrNoURL = errors.New("attachment has no url")
+var ErrNoFileServer = errors.New("no file server configured for uploads")
+var ErrUntrustedURL = errors.New("attachment url is not on a trusted file server")
+
+/// KeySize is the size of an attachment key, an aes-256 key followed by an hmac-sha256 key
+const KeySize = 64
+
+const macSize = sha256.Size
+
+/// DefaultMaxSize is the largest encrypted attachment downloaded when no limit is set
+const DefaultMaxSize = 10 * 1024 * 1024
+
+/// flagVoiceMessage marks an attachment recorded as a voice message
+const flagVoiceMessage = uint32(protobuf.AttachmentPointer_VOICE_MESSAGE)
+
+/// Attachment describes an attachment from its pointer, fields the sender left out are zero
+type Attachment struct {
+	ID          uint64
+	URL         string
+	ContentType string
+	FileName    string
+	Caption     string
+	/// Size is the size of the plaintext in bytes
+	Size         uint32
+	Width        uint32
+	Height       uint32
+	VoiceMessage bool
+}
+
+/// FromPointer reads the metadata of an attachment pointer
+func FromPointer(ptr *protobuf.AttachmentPointer) *Attachment {
+	return &Attachment{
+		ID:           ptr.GetId(),
+		URL:          ptr.GetUrl(),
+		ContentType:  ptr.GetContentType(),
+		FileName:     ptr.GetFileName(),
+		Caption:      ptr.GetCaption(),
+		Size:         ptr.GetSize(),
+		Width:        ptr.GetWidth(),
+		Height:       ptr.GetHeight(),
+		VoiceMessage: ptr.GetFlags()&flagVoiceMessage != 0,
+	}
+}
+
+/// minPaddedSize is the smallest size attachments are padded to before encryption
+const minPaddedSize = 541
+
+/// paddedSize rounds size up to the next step of 5% so the file server only learns roughly how large an attachment is
+func paddedSize(size int) int {
+	return int(math.Max(minPaddedSize, math.Floor(math.Pow(1.05, math.Ceil(math.Log(float64(size))/math.Log(1.05))))))
+}
+
+/// Encrypt pads and encrypts plain under a fresh key the way Decrypt expects, returning the key and the digest of the encrypted attachment
+func Encrypt(plain []byte) (key, data, digest []byte, err error) {
+	key = make([]byte, KeySize)
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(key)
+	if err == nil {
+		_, err = rand.Read(iv)
+	}
+	if err != nil {
+		return
+	}
+	padded := make([]byte, paddedSize(len(plain)))
+	copy(padded, plain)
+	pad := aes.BlockSize - len(padded)%aes.BlockSize
+	padded = append(padded, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return
+	}
+	data = make([]byte, aes.BlockSize+len(padded), aes.BlockSize+len(padded)+macSize)
+	copy(data, iv)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data[aes.BlockSize:], padded)
+	h := hmac.New(sha256.New, key[32:])
+	h.Write(data)
+	data = h.Sum(data)
+	sum := sha256.Sum256(data)
+	digest = sum[:]
+	return
+}
+
+/// Pointer makes an attachment pointer carrying the metadata of a, it has no key or digest
+func (a *Attachment) Pointer() *protobuf.AttachmentPointer {
+	ptr := &protobuf.AttachmentPointer{
+		ContentType: optional(a.ContentType),
+		FileName:    optional(a.FileName),
+		Caption:     optional(a.Caption),
+		Url:         optional(a.URL),
+		Size:        optionalUint(a.Size),
+		Width:       optionalUint(a.Width),
+		Height:      optionalUint(a.Height),
+	}
+	if a.ID != 0 {
+		id := a.ID
+		ptr.Id = &id
+	}
+	if a.VoiceMessage {
+		flags := flagVoiceMessage
+		ptr.Flags = &flags
+	}
+	return ptr
+}
+
+func optional(str string) *string {
+	if str == "" {
+		return nil
+	}
+	return &str
+}
+
+func optionalUint(val uint32) *uint32 {
+	if val == 0 {
+		return nil
+	}
+	return &val
+}
+
+/// Decrypt checks an encrypted attachment against its digest and mac and returns the plaintext cut to size, a size of 0 keeps all of it
+/// the encrypted attachment is a 16 byte iv, aes-256-cbc ciphertext with pkcs7 padding and an hmac-sha256 over both
+func Decrypt(key, digest, data []byte, size uint32) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, ErrBadKey
+	}
+	sum := sha256.Sum256(data)
+	if len(digest) == 0 || !hmac.Equal(sum[:], digest) {
+		return nil, ErrBadDigest
+	}
+	if len(data) < aes.BlockSize*2+macSize || (len(data)-macSize)%aes.BlockSize != 0 {
+		return nil, ErrMalformed
+	}
+	body, mac := data[:len(data)-macSize], data[len(data)-macSize:]
+	h := hmac.New(sha256.New, key[32:])
+	h.Write(body)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return nil, ErrBadMAC
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	iv, ciphertext := body[:aes.BlockSize], body[aes.BlockSize:]
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrMalformed
+	}
+	plain = plain[:len(plain)-pad]
+	if size > 0 && int(size) <= len(plain) {
+		plain = plain[:size]
+	}
+	return plain, nil
+}
+
+/// Downloader fetches and decrypts attachments
+type Downloader struct {
+	/// Server fetches encrypted attachments, defaults to an HTTPFileServer fetching the url in each pointer from DefaultFileServerHosts
+	Server FileServer
+	/// MaxSize is the largest encrypted attachment fetched in bytes, defaults to DefaultMaxSize
+	MaxSize int64
+}
+
+func (d *Downloader) server() FileServer {
+	if d.Server == nil {
+		return new(HTTPFileServer)
+	}
+	return d.Server
+}
+
+func (d *Downloader) maxSize() int64 {
+	if d.MaxSize > 0 {
+		return d.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+/// Download fetches the attachment ptr points to, checks it and returns a reader over the plaintext with the attachment's metadata
+func (d *Downloader) Download(ctx context.Context, ptr *protobuf.AttachmentPointer) (io.Reader, *Attachment, error) {
+	info := FromPointer(ptr)
+	if info.URL == "" {
+		return nil, info, ErrNoURL
+	}
+	body, err := d.server().Download(ctx, info.URL)
+	if err != nil {
+		return nil, info, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(body, d.maxSize()+1))
+	if err != nil {
+		return nil, info, fmt.Errorf("attachment download failed: %w", err)
+	}
+	if int64(len(data)) > d.maxSize() {
+		return nil, info, ErrTooLarge
+	}
+	plain, err := Decrypt(ptr.GetKey(), ptr.GetDigest(), data, info.Size)
+	if err != nil {
+		return nil, info, err
+	}
+	return bytes.NewReader(plain), info, nil
+}
+
+/// Uploader encrypts and uploads attachments
+type Uploader struct {
+	/// Server stores encrypted attachments, it must support uploads
+	Server FileServer
+	/// MaxSize is the largest attachment uploaded in bytes, defaults to DefaultMaxSize
+	MaxSize int64
+}
+
+func (u *Uploader) maxSize() int64 {
+	if u.MaxSize > 0 {
+		return u.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+/// Upload encrypts the contents of r under a fresh key, uploads it and returns a pointer to it described by info
+/// a missing content type is sniffed from the contents and missing dimensions are read from gif, jpeg and png images
+func (u *Uploader) Upload(ctx context.Context, r io.Reader, info Attachment) (*protobuf.AttachmentPointer, error) {
+	if u.Server == nil {
+		return nil, ErrNoFileServer
+	}
+	plain, err := ioutil.ReadAll(io.LimitReader(r, u.maxSize()+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(plain)) > u.maxSize() {
+		return nil, ErrTooLarge
+	}
+	if info.ContentType == "" {
+		info.ContentType = http.DetectContentType(plain)
+	}
+	if info.Width == 0 && info.Height == 0 {
+		if conf, _, err := image.DecodeConfig(bytes.NewReader(plain)); err == nil {
+			info.Width = uint32(conf.Width)
+			info.Height = uint32(conf.Height)
+		}
+	}
+	key, data, digest, err := Encrypt(plain)
+	if err != nil {
+		return nil, err
+	}
+	info.URL, err = u.Server.Upload(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = uint32(len(plain))
+	ptr := info.Pointer()
+	ptr.Key = key
+	ptr.Digest = digest
+	return ptr, nil
+}
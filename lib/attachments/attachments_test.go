@@ -0,0 +1,223 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/majestrate/ubw/lib/protobuf"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+/// sessionEncode encrypts plain the way session clients do, zero padded to padTo, independently of Encrypt
+func sessionEncode(key, iv, plain []byte, padTo int) []byte {
+	padded := append(append([]byte(nil), plain...), make([]byte, padTo-len(plain))...)
+	pad := 16 - len(padded)%16
+	padded = append(padded, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, _ := aes.NewCipher(key[:32])
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	body := append(append([]byte(nil), iv...), ciphertext...)
+	h := hmac.New(sha256.New, key[32:])
+	h.Write(body)
+	return h.Sum(body)
+}
+
+/// sessionDecode undoes sessionEncode without checking the digest, returning the plaintext with its zero padding
+func sessionDecode(key, data []byte) ([]byte, bool) {
+	body, mac := data[:len(data)-32], data[len(data)-32:]
+	h := hmac.New(sha256.New, key[32:])
+	h.Write(body)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return nil, false
+	}
+	block, _ := aes.NewCipher(key[:32])
+	plain := make([]byte, len(body)-16)
+	cipher.NewCBCDecrypter(block, body[:16]).CryptBlocks(plain, body[16:])
+	return plain[:len(plain)-int(plain[len(plain)-1])], true
+}
+
+/// knownDigest is the sha256 of sessionEncode(0..63, 64..79, "a picture of a cat", 541) as computed by openssl
+const knownDigest = "6557788e96166898163f7890d4abbe6b68d9263e969d275f29e50c1df7c8de62"
+
+func TestSessionFormat(t *testing.T) {
+	key, iv := make([]byte, KeySize), make([]byte, 16)
+	for idx := range key {
+		key[idx] = byte(idx)
+	}
+	for idx := range iv {
+		iv[idx] = byte(64 + idx)
+	}
+	plain := []byte("a picture of a cat")
+	data := sessionEncode(key, iv, plain, 541)
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != knownDigest {
+		t.Fatalf("test encoder does not match the known answer, digest %x", digest)
+	}
+	got, err := Decrypt(key, digest[:], data, uint32(len(plain)))
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted known answer to %q %v", got, err)
+	}
+
+	key, data, encDigest, err := Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest = sha256.Sum256(data)
+	if !bytes.Equal(encDigest, digest[:]) {
+		t.Fatal("Encrypt returned the wrong digest")
+	}
+	padded, ok := sessionDecode(key, data)
+	if !ok || len(padded) != 541 || !bytes.Equal(padded[:len(plain)], plain) || !bytes.Equal(padded[len(plain):], make([]byte, 541-len(plain))) {
+		t.Fatalf("Encrypt output is not in session's format: %q", padded)
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	plain := []byte("a picture of a cat")
+	key, data, digest, err := Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < minPaddedSize {
+		t.Fatalf("attachment of %d bytes was not padded", len(data))
+	}
+
+	got, err := Decrypt(key, digest, data, uint32(len(plain)))
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted %q %v", got, err)
+	}
+	if _, err = Decrypt(key[:32], digest, data, 0); err != ErrBadKey {
+		t.Fatalf("short key gave %v", err)
+	}
+	if _, err = Decrypt(key, make([]byte, sha256.Size), data, 0); err != ErrBadDigest {
+		t.Fatalf("wrong digest gave %v", err)
+	}
+	tampered := append([]byte(nil), data...)
+	tampered[20] ^= 1
+	sum := sha256.Sum256(tampered)
+	if _, err = Decrypt(key, sum[:], tampered, 0); err != ErrBadMAC {
+		t.Fatalf("tampered attachment gave %v", err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	plain := []byte("GIF89a...")
+	key, data, digest, err := Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file/1234" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+	base, _ := url.Parse(srv.URL)
+
+	size := uint32(len(plain))
+	contentType, fileName, width := "image/gif", "cat.gif", uint32(640)
+	fileURL := "https://files.example.org/file/1234"
+	ptr := &protobuf.AttachmentPointer{Url: &fileURL, Key: key, Digest: digest, Size: &size, ContentType: &contentType, FileName: &fileName, Width: &width}
+	d := &Downloader{Server: &HTTPFileServer{Base: base, Client: srv.Client()}}
+	var r io.Reader
+	var info *Attachment
+	r, info, err = d.Download(context.Background(), ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("downloaded %q", got)
+	}
+	if info.ContentType != contentType || info.FileName != fileName || info.Width != width || info.Size != size {
+		t.Fatalf("bad metadata %+v", info)
+	}
+
+	d.MaxSize = int64(len(data) - 1)
+	if _, _, err = d.Download(context.Background(), ptr); err != ErrTooLarge {
+		t.Fatalf("oversized attachment gave %v", err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	var stored []byte
+	id := `1234`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/file" || r.Header.Get("Content-Type") != "application/octet-stream" {
+			http.NotFound(w, r)
+			return
+		}
+		stored, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id": `+id+`}`)
+	}))
+	defer srv.Close()
+	base, _ := url.Parse(srv.URL)
+	fs := &HTTPFileServer{Base: base, Client: srv.Client()}
+
+	fileURL, err := fs.Upload(context.Background(), []byte("encrypted"))
+	if err != nil {
+		t.Fatalf("upload failed: %s", err.Error())
+	}
+	if fileURL != srv.URL+"/file/1234" || string(stored) != "encrypted" {
+		t.Fatalf("uploaded %q to %s", stored, fileURL)
+	}
+	id = `"abcd"`
+	fileURL, err = fs.Upload(context.Background(), []byte("encrypted"))
+	if err != nil || fileURL != srv.URL+"/file/abcd" {
+		t.Fatalf("upload with a string id gave %s %v", fileURL, err)
+	}
+	id = `null`
+	if _, err = fs.Upload(context.Background(), []byte("encrypted")); err != ErrNoURL {
+		t.Fatalf("upload without an id gave %v", err)
+	}
+}
+
+func TestDownloadRefusesUntrustedURLs(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "https://127.0.0.2/file/1", http.StatusFound)
+			return
+		}
+		w.Write([]byte("encrypted"))
+	}))
+	defer srv.Close()
+	fileURL, _ := url.Parse(srv.URL)
+
+	for _, tc := range []struct {
+		name string
+		url  string
+		fs   *HTTPFileServer
+		err  error
+	}{
+		{"default hosts", srv.URL + "/file/1", &HTTPFileServer{}, ErrUntrustedURL},
+		{"plain http", "http://" + fileURL.Host + "/file/1", &HTTPFileServer{AllowedHosts: []string{fileURL.Host}}, ErrUntrustedURL},
+		{"allowed host", srv.URL + "/file/1", &HTTPFileServer{AllowedHosts: []string{fileURL.Host}}, nil},
+		{"any host", srv.URL + "/file/1", &HTTPFileServer{AllowAnyHost: true}, nil},
+		{"any host over http", "http://" + fileURL.Host + "/file/1", &HTTPFileServer{AllowAnyHost: true}, ErrUntrustedURL},
+		{"redirect away", srv.URL + "/redirect", &HTTPFileServer{AllowedHosts: []string{fileURL.Host}}, ErrUntrustedURL},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fs.Client = srv.Client()
+			body, err := tc.fs.Download(context.Background(), tc.url)
+			if err == nil {
+				body.Close()
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+/// Package attachmentstest runs an in-process fake of session's file server so attachment
+/// uploads and downloads can be exercised without touching the real network.
+package attachmentstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/majestrate/ubw/lib/attachments"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+/// Server is a fake file server that keeps uploads in memory
+type Server struct {
+	mtx    sync.Mutex
+	files  map[string][]byte
+	nextID int
+	srv    *httptest.Server
+}
+
+/// NewServer starts a fake file server, call Close when done with it
+func NewServer() *Server {
+	s := &Server{files: make(map[string][]byte)}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/file":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mtx.Lock()
+		s.nextID++
+		id := s.nextID
+		s.files[fmt.Sprint(id)] = data
+		s.mtx.Unlock()
+		// like session's file server the id is a number
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]int{"id": id})
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/file/"):
+		s.mtx.Lock()
+		data, ok := s.files[strings.TrimPrefix(r.URL.Path, "/file/")]
+		s.mtx.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+/// FileServer returns a client for the fake file server
+func (s *Server) FileServer() attachments.FileServer {
+	base, _ := url.Parse(s.srv.URL)
+	return &attachments.HTTPFileServer{Client: s.srv.Client(), Base: base}
+}
+
+/// URL is the base url of the fake file server
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+/// Len returns how many files have been uploaded
+func (s *Server) Len() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.files)
+}
+
+/// File returns the encrypted contents of an uploaded file by its url
+func (s *Server) File(fileURL string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	data, ok := s.files[strings.TrimPrefix(fileURL, s.srv.URL+"/file/")]
+	return data, ok
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
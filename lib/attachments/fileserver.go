@@ -0,0 +1,162 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/// FileServer stores encrypted attachments
+type FileServer interface {
+	/// Download fetches the encrypted attachment at an attachment pointer's url
+	Download(ctx context.Context, url string) (io.ReadCloser, error)
+	/// Upload stores an encrypted attachment and returns the url it can be fetched from
+	Upload(ctx context.Context, data []byte) (string, error)
+}
+
+/// DefaultFileServerHosts are the file servers attachment urls may point at when HTTPFileServer has no Base or AllowedHosts
+var DefaultFileServerHosts = []string{"filev2.getsession.org", "file.getsession.org"}
+
+/// DefaultFileServer is where attachments are uploaded when HTTPFileServer has no Base, session's own file server
+const DefaultFileServer = "https://filev2.getsession.org"
+
+/// HTTPFileServer fetches and uploads attachments over http the way session's file server expects
+/// downloads are plain GETs of the attachment url, uploads post the encrypted attachment as the body of a request to /file
+/// and the server answers with the json object {"id": ...}, the attachment is then at /file/<id>
+type HTTPFileServer struct {
+	/// Client defaults to rpc.DefaultCAClient
+	Client *http.Client
+	/// Base replaces the scheme and host of every attachment url if set, for mirrors and self hosted file servers
+	/// it is also where attachments are uploaded, DefaultFileServer if it is not set
+	Base *url.URL
+	/// AllowedHosts are the hosts attachment urls may point at when Base is not set, defaults to DefaultFileServerHosts
+	AllowedHosts []string
+	/// AllowAnyHost fetches attachment urls from any https host when Base is not set, senders choose the url so this lets them make us connect anywhere
+	AllowAnyHost bool
+}
+
+/// uploadResponse is what the file server answers an upload with, servers differ on whether the id is a number or a string
+type uploadResponse struct {
+	ID json.RawMessage `json:"id"`
+}
+
+func (s *HTTPFileServer) client() *http.Client {
+	if s.Client == nil {
+		return rpc.DefaultCAClient
+	}
+	return s.Client
+}
+
+func (s *HTTPFileServer) allowedHosts() []string {
+	if s.AllowedHosts == nil {
+		return DefaultFileServerHosts
+	}
+	return s.AllowedHosts
+}
+
+/// checkURL refuses urls we should not fetch attachments from, only Base when it is set and otherwise https urls on an allowed host
+func (s *HTTPFileServer) checkURL(u *url.URL) error {
+	if s.Base != nil {
+		if u.Scheme != s.Base.Scheme || u.Host != s.Base.Host {
+			return ErrUntrustedURL
+		}
+		return nil
+	}
+	if u.Scheme != "https" {
+		return ErrUntrustedURL
+	}
+	if s.AllowAnyHost {
+		return nil
+	}
+	for _, host := range s.allowedHosts() {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+	return ErrUntrustedURL
+}
+
+func (s *HTTPFileServer) Download(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if s.Base != nil {
+		u.Scheme = s.Base.Scheme
+		u.Host = s.Base.Host
+		u.User = s.Base.User
+	}
+	err = s.checkURL(u)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// redirects must stay on trusted file servers too
+	client := *s.client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return s.checkURL(req.URL)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &rpc.StatusError{StatusCode: resp.StatusCode}
+	}
+	return resp.Body, nil
+}
+
+/// uploadBase returns the file server uploads go to
+func (s *HTTPFileServer) uploadBase() (*url.URL, error) {
+	if s.Base != nil {
+		return s.Base, nil
+	}
+	return url.Parse(DefaultFileServer)
+}
+
+func (s *HTTPFileServer) Upload(ctx context.Context, data []byte) (string, error) {
+	base, err := s.uploadBase()
+	if err != nil {
+		return "", err
+	}
+	u := *base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/file"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", &rpc.StatusError{StatusCode: resp.StatusCode}
+	}
+	var uploaded uploadResponse
+	err = json.NewDecoder(resp.Body).Decode(&uploaded)
+	if err != nil {
+		return "", fmt.Errorf("bad upload response: %w", err)
+	}
+	id := strings.Trim(string(uploaded.ID), `"`)
+	if id == "" || id == "null" || strings.ContainsAny(id, "/?#") {
+		return "", ErrNoURL
+	}
+	u.Path += "/" + id
+	return u.String(), nil
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"context"
+	"github.com/majestrate/ubw/lib/attachments"
+	"github.com/majestrate/ubw/lib/model"
+	"github.com/majestrate/ubw/lib/protobuf"
+	"io"
+)
+
+func (cl *Client) fileServer() attachments.FileServer {
+	if cl.opts.FileServer == nil {
+		return &attachments.HTTPFileServer{Client: cl.caHTTP}
+	}
+	return cl.opts.FileServer
+}
+
+func (cl *Client) downloader() *attachments.Downloader {
+	return &attachments.Downloader{Server: cl.fileServer(), MaxSize: cl.opts.MaxAttachmentSize}
+}
+
+/// Download fetches and decrypts an attachment from a received message, see PlainMessage.Attachments
+func (cl *Client) Download(ctx context.Context, ptr *protobuf.AttachmentPointer) (io.Reader, *attachments.Attachment, error) {
+	return cl.downloader().Download(ctx, ptr)
+}
+
+/// Upload encrypts the contents of r and uploads it to our file server, returning a pointer to put in an outgoing message
+func (cl *Client) Upload(ctx context.Context, r io.Reader, info attachments.Attachment) (*protobuf.AttachmentPointer, error) {
+	uploader := &attachments.Uploader{Server: cl.fileServer(), MaxSize: cl.opts.MaxAttachmentSize}
+	return uploader.Upload(ctx, r, info)
+}
+
+/// SendAttachment uploads the contents of r described by info and sends dst a message carrying it
+func (cl *Client) SendAttachment(ctx context.Context, dst string, r io.Reader, info attachments.Attachment) (*SendResult, error) {
+	ptr, err := cl.Upload(ctx, r, info)
+	if err != nil {
+		return nil, err
+	}
+	return cl.Send(ctx, dst, model.NewMessage().Attach(ptr).Build())
+}
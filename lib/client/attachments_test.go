@@ -0,0 +1,63 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"github.com/majestrate/ubw/lib/attachments"
+	"github.com/majestrate/ubw/lib/attachments/attachmentstest"
+	"github.com/majestrate/ubw/lib/swarm/swarmtest"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSendAttachment(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 3)
+	defer net.Close()
+	files := attachmentstest.NewServer()
+	defer files.Close()
+
+	alice := newTestClient(t, net)
+	alice.opts.FileServer = files.FileServer()
+	bob := newTestClient(t, net)
+	bob.opts.FileServer = files.FileServer()
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 32, 16)))
+	picture := img.Bytes()
+	_, err := alice.SendAttachment(context.Background(), bob.SessionID(), bytes.NewReader(picture), attachments.Attachment{FileName: "square.png"})
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	if files.Len() != 1 {
+		t.Fatalf("%d files uploaded", files.Len())
+	}
+
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("fetched %d messages: %v", len(msgs), err)
+	}
+	plain, err := bob.DecryptMessage(msgs[0])
+	if err != nil {
+		t.Fatalf("decrypt failed: %s", err.Error())
+	}
+	if len(plain.Attachments()) != 1 {
+		t.Fatalf("message has %d attachments", len(plain.Attachments()))
+	}
+	stored, _ := files.File(plain.Attachments()[0].GetUrl())
+	if bytes.Contains(stored, picture[:16]) {
+		t.Fatal("file server got the attachment in the clear")
+	}
+	r, info, err := bob.Download(context.Background(), plain.Attachments()[0])
+	if err != nil {
+		t.Fatalf("download failed: %s", err.Error())
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, picture) {
+		t.Fatal("downloaded attachment differs")
+	}
+	if info.FileName != "square.png" || info.ContentType != "image/png" || info.Width != 32 || info.Height != 16 || int(info.Size) != len(picture) {
+		t.Fatalf("unexpected metadata %+v", info)
+	}
+}
@@ -1,19 +1,49 @@
 package client
 
 import (
-	_ "errors"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/majestrate/ubw/lib/cryptography"
 	"github.com/majestrate/ubw/lib/model"
 	"github.com/majestrate/ubw/lib/swarm"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
+	"math/rand"
+	"net/http"
+	"sync"
 	"time"
 )
 
+var ErrNoSeedNodes = errors.New("no seed nodes configured")
+
+/// refreshSources is how many known nodes the snode list is pulled from on each refresh
+const refreshSources = 3
+
+/// updateRetryDelay is how long RunUpdates waits before retrying a failed update
+const updateRetryDelay = 10 * time.Second
+
+/// Client sends and receives session messages, it is safe for concurrent use so handlers may send while Subscribe or Run is receiving
 type Client struct {
 	keys     *cryptography.KeyPair
 	snodes   SnodeMap
 	store    MessageStore
 	ourSwarm *swarm.ServiceNode
+	opts     ClientOptions
+	paths    pathSet
+	swarms   swarmCache
+	http     *http.Client
+	caHTTP   *http.Client
+	pins     *rpc.Pinner
+
+	updateMtx sync.Mutex
+	/// recvMtx makes checking for and storing new messages atomic so concurrent polls never return the same message twice
+	recvMtx sync.Mutex
+	/// undelivered holds messages a subscription stored but could not hand over before its context ended, guarded by recvMtx
+	undelivered []*model.PlainMessage
+	/// outboxMtx keeps concurrent outbox passes from sending the same message twice
+	outboxMtx sync.Mutex
+	/// outboxWake wakes RunOutbox when a message is queued
+	outboxWake chan struct{}
 }
 
 func (cl *Client) Store() MessageStore {
@@ -24,62 +54,232 @@ func (cl *Client) SessionID() string {
 	return cl.keys.SessionID()
 }
 
-func NewClient(keys *cryptography.KeyPair, store MessageStore) *Client {
+func NewClient(keys *cryptography.KeyPair, store MessageStore, opts *ClientOptions) *Client {
 	if store == nil {
 		store = MemoryStore()
 	}
+	if opts == nil {
+		opts = new(ClientOptions)
+	}
+	if adopter, ok := store.(unownedAdopter); ok {
+		// a failure leaves the rows without an owner and they are adopted on the next start
+		adopter.AdoptUnowned(keys.SessionID())
+	}
 	return &Client{
-		keys: keys,
+		http:   rpc.NewHTTPClient(opts.HTTP),
+		caHTTP: rpc.NewCAHTTPClient(opts.HTTP),
+		pins:   rpc.NewPinner(opts.HTTP),
+		keys:   keys,
 		snodes: SnodeMap{
 			snodeMap:     make(map[string]swarm.ServiceNode),
 			nextUpdateAt: time.Now(),
 		},
 		store: store,
+		opts:  *opts,
+		paths: pathSet{
+			num:      opts.numPaths(),
+			lifetime: opts.pathLifetime(),
+		},
+		outboxWake: make(chan struct{}, 1),
 	}
 }
 
-func (cl *Client) Update() {
+/// requestContext derives the context for a single request to a service node from ctx
+func (cl *Client) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, cl.opts.requestTimeout())
+}
+
+/// Update bootstraps the snode list from the seed nodes if we do not have one yet, seeds are tried in random order until one answers
+/// once we have a list it is refreshed from several known nodes whenever it is due, the old list is kept if the refresh fails
+func (cl *Client) Update(ctx context.Context) error {
+	cl.updateMtx.Lock()
+	defer cl.updateMtx.Unlock()
 	if cl.snodes.Empty() {
-		swarm.WithSeedNodes(func(node swarm.ServiceNode) {
-			err := cl.snodes.Update(node)
-			if err != nil {
-				fmt.Printf("Failed to fetch from seed node: %s\n", err.Error())
+		return cl.bootstrap(ctx)
+	}
+	if cl.snodes.ShouldUpdate() {
+		return cl.refresh(ctx)
+	}
+	return nil
+}
+
+func (cl *Client) bootstrap(ctx context.Context) error {
+	seeds, err := cl.opts.seedNodes()
+	if err != nil {
+		return err
+	}
+	if len(seeds) == 0 {
+		return ErrNoSeedNodes
+	}
+	for _, idx := range rand.Perm(len(seeds)) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		reqCtx, cancel := cl.requestContext(ctx)
+		err = cl.snodes.Update(reqCtx, seeds[idx].Using(cl.directTransport()))
+		cancel()
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("failed to fetch from seed node %s: %s", seeds[idx].SNodeAddr(), err.Error())
+	}
+	return err
+}
+
+/// refresh pulls the snode list from the storage servers of refreshSources random known nodes at once and merges the results
+func (cl *Client) refresh(ctx context.Context) error {
+	sources := cl.snodes.RandomN(refreshSources)
+	lists := make([][]swarm.ServiceNode, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for idx := range sources {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			reqCtx, cancel := cl.requestContext(ctx)
+			defer cancel()
+			node := sources[idx].Using(cl.directTransport())
+			started := time.Now()
+			lists[idx], errs[idx] = node.FetchSNodeList(reqCtx)
+			cl.report(sources[idx], started, errs[idx])
+		}(idx)
+	}
+	wg.Wait()
+	var fetched [][]swarm.ServiceNode
+	var err error
+	for idx, list := range lists {
+		if errs[idx] != nil {
+			err = errs[idx]
+			continue
+		}
+		if len(list) > 0 {
+			fetched = append(fetched, list)
+		}
+	}
+	if len(fetched) == 0 {
+		if err == nil {
+			err = errors.New("no nodes returned")
+		}
+		return fmt.Errorf("snode list refresh failed: %s", err.Error())
+	}
+	cl.snodes.Replace(mergeSNodeLists(fetched))
+	return nil
+}
+
+/// SNodeStats returns what we know about how each service node we talked to has behaved, keyed by identity key
+func (cl *Client) SNodeStats() map[string]NodeStats {
+	return cl.snodes.Stats()
+}
+
+/// RunUpdates keeps the snode list fresh in the background until ctx is done, onError is called with failed updates and may be nil
+func (cl *Client) RunUpdates(ctx context.Context, onError func(error)) {
+	for {
+		wait := updateRetryDelay
+		err := cl.Update(ctx)
+		if err != nil {
+			if onError != nil && ctx.Err() == nil {
+				onError(err)
 			}
-		})
+		} else {
+			wait = time.Until(cl.snodes.NextUpdateAt())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
 	}
 }
+
 func (cl *Client) withRandomSNode(visit func(swarm.ServiceNode)) {
 	visit(cl.snodes.Random())
 }
 
-func (cl *Client) FetchNewMessages() ([]model.Message, error) {
-	return cl.recvFrom(cl.SessionID())
+func (cl *Client) FetchNewMessages(ctx context.Context) ([]model.Message, error) {
+	return cl.recvFrom(ctx, cl.SessionID())
 }
 
-func (cl *Client) RecvFromHash(src string) ([]model.Message, error) {
+func (cl *Client) RecvFromHash(ctx context.Context, src string) ([]model.Message, error) {
 	src = "05" + cryptography.B2SumHex(src)
-	return cl.recvFrom(src)
+	return cl.recvFrom(ctx, src)
 }
 
-func (cl *Client) recvFrom(src string) (found []model.Message, err error) {
-	node := cl.snodes.Random()
-	msgs, err2 := node.FetchMessages(src, cl.store.LastHash())
-	err = err2
-	if err == nil {
-		for _, msg := range msgs {
-			if cl.store.HasMessage(msg.Hash) {
-				continue
-			}
-			err = cl.store.Put(msg)
-			if err != nil {
-				return
-			}
-			found = append(found, msg)
+/// received is a message fetched from a swarm that we have not seen yet, with the result of decrypting it
+type received struct {
+	msg   model.Message
+	plain *model.PlainMessage
+	err   error
+}
+
+/// recvFrom polls the swarm for src for messages we have not seen yet, failing over between swarm members, and stores them
+func (cl *Client) recvFrom(ctx context.Context, src string) (found []model.Message, err error) {
+	fetched, err := cl.fetchFrom(ctx, src)
+	if err != nil {
+		return
+	}
+	for _, r := range fetched {
+		var kept bool
+		kept, err = cl.keep(r)
+		if err != nil {
+			return
+		}
+		if kept {
+			found = append(found, r.msg)
 		}
 	}
 	return
 }
 
+/// fetchFrom polls the swarm for src and decrypts the messages we have not seen yet without storing them, see keep
+func (cl *Client) fetchFrom(ctx context.Context, src string) ([]received, error) {
+	var msgs []model.Message
+	err := cl.withSwarm(ctx, src, func(node swarm.ServiceNode) error {
+		reqCtx, cancel := cl.requestContext(ctx)
+		defer cancel()
+		var err error
+		msgs, err = node.Retrieve(reqCtx, src, cl.store.LastHash(src))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var fetched []received
+	for _, msg := range msgs {
+		if cl.store.HasMessage(msg.Hash) {
+			continue
+		}
+		msg.Owner = src
+		msg.Expiration = expiration(msg)
+		plain, decryptErr := cl.DecryptMessage(msg)
+		if decryptErr == nil {
+			msg.From = plain.From
+			if plain.Message != nil {
+				msg.SentAt = plain.Message.GetTimestamp()
+			}
+		}
+		fetched = append(fetched, received{msg: msg, plain: plain, err: decryptErr})
+	}
+	return fetched, nil
+}
+
+/// keep stores a fetched message and adds it to our history so it is not fetched again
+/// it returns false if it was stored already, by us or by another client sharing the store, and only the caller that got true may deliver it
+func (cl *Client) keep(r received) (bool, error) {
+	cl.recvMtx.Lock()
+	defer cl.recvMtx.Unlock()
+	if cl.store.HasMessage(r.msg.Hash) {
+		return false, nil
+	}
+	inserted, err := cl.store.Put(r.msg)
+	if err != nil || !inserted {
+		return false, err
+	}
+	if r.err == nil {
+		err = cl.recordConversation(r.msg.Hash, r.plain.From, Incoming, r.plain)
+	}
+	return true, err
+}
+
 func (cl *Client) DecryptMessage(msg model.Message) (*model.PlainMessage, error) {
 	return msg.Decrypt(cl.keys)
 }
@@ -89,14 +289,25 @@ func (cl *Client) makePlain(data string) *model.PlainMessage {
 	return msg
 }
 
-func (cl *Client) SendTo(dst, body string) error {
-	msg := cl.makePlain(body)
+/// SendTo encrypts body for dst and stores it in dst's swarm, an error wrapping ErrQuorumNotReached is returned with the result if fewer than StoreQuorum members accepted it
+func (cl *Client) SendTo(ctx context.Context, dst, body string) (*SendResult, error) {
+	return cl.Send(ctx, dst, cl.makePlain(body))
+}
+
+/// Send encrypts msg for dst, stores it in dst's swarm and records it in our history, build msg with model.NewMessage
+func (cl *Client) Send(ctx context.Context, dst string, msg *model.PlainMessage) (*SendResult, error) {
 	raw, err := msg.Encrypt(cl.keys, dst)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	cl.snodes.VisitSwarmFor(dst, 1, func(node swarm.ServiceNode) {
-		node.StoreMessage(dst, model.Message{Raw: raw})
-	})
-	return nil
+	result, err := cl.send(ctx, dst, model.Message{Raw: raw})
+	if err != nil {
+		return result, err
+	}
+	return result, cl.recordConversation(rawID(raw), dst, Outgoing, msg)
+}
+
+/// ReplyTo sends body to the sender of orig quoting orig, so the reply shows up attached to it
+func (cl *Client) ReplyTo(ctx context.Context, orig *model.PlainMessage, body string) (*SendResult, error) {
+	return cl.Send(ctx, orig.From, model.NewMessage().Body(body).ReplyTo(orig).Build())
 }
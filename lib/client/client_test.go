@@ -0,0 +1,501 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"github.com/majestrate/ubw/lib/model"
+	"github.com/majestrate/ubw/lib/protobuf"
+	"github.com/majestrate/ubw/lib/swarm"
+	"github.com/majestrate/ubw/lib/swarm/swarmtest"
+	"google.golang.org/protobuf/encoding/protowire"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, net *swarmtest.Network) *Client {
+	cl := NewClient(cryptography.Keygen(), nil, &ClientOptions{
+		SeedNodes: []swarm.ServiceNode{net.Seed()},
+	})
+	err := cl.Update(context.Background())
+	if err != nil {
+		t.Fatalf("failed to bootstrap snode list: %s", err.Error())
+	}
+	return cl
+}
+
+func TestSendAndReceive(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+
+	_, err := alice.SendTo(context.Background(), bob.SessionID(), "hello bob")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	plain, err := bob.DecryptMessage(msgs[0])
+	if err != nil {
+		t.Fatalf("decrypt failed: %s", err.Error())
+	}
+	if plain.From != alice.SessionID() {
+		t.Fatalf("message from %s, expected %s", plain.From, alice.SessionID())
+	}
+	if body := plain.Body(); body == nil || *body != "hello bob" {
+		t.Fatalf("unexpected body: %v", body)
+	}
+
+	msgs, err = bob.FetchNewMessages(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("expected no new messages, got %d", len(msgs))
+	}
+
+	for _, side := range []struct {
+		cl        *Client
+		thread    string
+		direction Direction
+	}{
+		{alice, bob.SessionID(), Outgoing},
+		{bob, alice.SessionID(), Incoming},
+	} {
+		history, err := side.cl.History(HistoryQuery{Thread: side.thread})
+		if err != nil {
+			t.Fatalf("history failed: %s", err.Error())
+		}
+		if len(history) != 1 || history[0].Direction != side.direction || history[0].Body != "hello bob" || history[0].From != alice.SessionID() {
+			t.Fatalf("unexpected %s history: %+v", side.direction, history)
+		}
+	}
+}
+
+func TestSendBuiltMessage(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+
+	msg := model.NewMessage().
+		Body("see this").
+		Quote(1600000000000, bob.SessionID(), "what was it").
+		Preview("https://example.org/", "example", nil).
+		Profile("alice", "").
+		ExpireTimer(time.Hour).
+		ContactCard("carol", "+15550100").
+		Build()
+	_, err := alice.Send(context.Background(), bob.SessionID(), msg)
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("fetched %d messages: %v", len(msgs), err)
+	}
+	plain, err := bob.DecryptMessage(msgs[0])
+	if err != nil {
+		t.Fatalf("decrypt failed: %s", err.Error())
+	}
+	data := plain.Message
+	if data.GetBody() != "see this" || data.GetQuote().GetAuthor() != bob.SessionID() || data.GetQuote().GetId() != 1600000000000 {
+		t.Fatalf("bad body or quote: %v", data)
+	}
+	if len(data.GetPreview()) != 1 || data.GetProfile().GetDisplayName() != "alice" || data.GetExpireTimer() != 3600 {
+		t.Fatalf("bad preview, profile or timer: %v", data)
+	}
+	if len(data.GetContact()) != 1 || data.GetContact()[0].GetNumber()[0].GetValue() != "+15550100" {
+		t.Fatalf("bad contact: %v", data.GetContact())
+	}
+}
+
+func TestReplyTo(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+
+	_, err := alice.SendTo(context.Background(), bob.SessionID(), "ping")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("fetched %d messages: %v", len(msgs), err)
+	}
+	orig, err := bob.DecryptMessage(msgs[0])
+	if err != nil {
+		t.Fatalf("decrypt failed: %s", err.Error())
+	}
+	_, err = bob.ReplyTo(context.Background(), orig, "pong")
+	if err != nil {
+		t.Fatalf("reply failed: %s", err.Error())
+	}
+	msgs, err = alice.FetchNewMessages(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("fetched %d replies: %v", len(msgs), err)
+	}
+	reply, err := alice.DecryptMessage(msgs[0])
+	if err != nil {
+		t.Fatalf("decrypt failed: %s", err.Error())
+	}
+	quote := reply.Message.GetQuote()
+	if reply.From != bob.SessionID() || quote.GetId() != orig.SentAt() || quote.GetAuthor() != alice.SessionID() || quote.GetText() != "ping" {
+		t.Fatalf("reply does not quote the original: %v", reply.Message)
+	}
+}
+
+func TestContentKinds(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+
+	// field 99 of Content is not one we know
+	unknown := protowire.AppendBytes(protowire.AppendTag(nil, 99, protowire.BytesType), []byte("from the future"))
+	sent := []*model.PlainMessage{
+		model.MakeTyping(protobuf.TypingMessage_STARTED),
+		model.MakeReceipt(protobuf.ReceiptMessage_READ, 1600000000000),
+		{Kind: model.ContentConfiguration, Configuration: &protobuf.ConfigurationMessage{OpenGroups: []string{"https://example.org/lobby"}}},
+		{Kind: model.ContentUnknown, Raw: unknown},
+		model.MakePlain("hi"),
+	}
+	for _, msg := range sent {
+		_, err := alice.Send(context.Background(), bob.SessionID(), msg)
+		if err != nil {
+			t.Fatalf("sending %s failed: %s", msg.Kind, err.Error())
+		}
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil || len(msgs) != len(sent) {
+		t.Fatalf("fetched %d messages: %v", len(msgs), err)
+	}
+	kinds := make(map[model.ContentKind]*model.PlainMessage)
+	for _, msg := range msgs {
+		plain, err := bob.DecryptMessage(msg)
+		if err != nil {
+			t.Fatalf("decrypt failed: %s", err.Error())
+		}
+		kinds[plain.Kind] = plain
+	}
+	if plain := kinds[model.ContentTyping]; plain == nil || plain.Typing.GetAction() != protobuf.TypingMessage_STARTED {
+		t.Fatalf("typing indicator did not arrive: %v", plain)
+	}
+	if plain := kinds[model.ContentReceipt]; plain == nil || plain.Receipt.GetType() != protobuf.ReceiptMessage_READ || plain.Receipt.GetTimestamp()[0] != 1600000000000 {
+		t.Fatalf("receipt did not arrive: %v", plain)
+	}
+	if plain := kinds[model.ContentConfiguration]; plain == nil || len(plain.Configuration.GetOpenGroups()) != 1 {
+		t.Fatalf("configuration did not arrive: %v", plain)
+	}
+	if plain := kinds[model.ContentUnknown]; plain == nil || !bytes.Equal(plain.Raw, unknown) {
+		t.Fatalf("unknown content did not arrive: %v", plain)
+	}
+	if plain := kinds[model.ContentData]; plain == nil || *plain.Body() != "hi" {
+		t.Fatalf("data message did not arrive: %v", plain)
+	}
+}
+
+func TestSendAndReceiveOnion(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	alice.opts.OnionRequests = true
+	bob := newTestClient(t, net)
+	bob.opts.OnionRequests = true
+
+	_, err := alice.SendTo(context.Background(), bob.SessionID(), "hello through the onion")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	if len(net.Messages(bob.SessionID())) != 1 {
+		t.Fatal("message was not stored")
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if len(bob.paths.paths) == 0 {
+		t.Fatal("no onion paths were built")
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 1)
+	defer net.Close()
+
+	cl := newTestClient(t, net)
+	for i := 0; i < 5; i++ {
+		_, err := cl.FetchNewMessages(context.Background())
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err.Error())
+		}
+	}
+	if conns := net.Node(0).Connections(); conns != 1 {
+		t.Fatalf("expected 1 connection to be reused, got %d", conns)
+	}
+}
+
+func TestPeriodicRefresh(t *testing.T) {
+	net := swarmtest.NewNetwork(2, 3)
+
+	cl := newTestClient(t, net)
+	if cl.snodes.ShouldUpdate() {
+		t.Fatal("fresh snode list should not need an update")
+	}
+	seedRequests := net.Node(0).Requests()
+
+	cl.snodes.mtx.Lock()
+	cl.snodes.nextUpdateAt = time.Now()
+	cl.snodes.mtx.Unlock()
+	if !cl.snodes.ShouldUpdate() {
+		t.Fatal("stale snode list should need an update")
+	}
+	err := cl.Update(context.Background())
+	if err != nil {
+		t.Fatalf("refresh failed: %s", err.Error())
+	}
+	if len(cl.snodes.All()) != 6 {
+		t.Fatalf("expected 6 nodes after refresh, got %d", len(cl.snodes.All()))
+	}
+	total := 0
+	for idx := range net.Nodes() {
+		total += net.Node(idx).Requests()
+	}
+	if total-seedRequests < refreshSources-1 {
+		t.Fatalf("refresh did not ask several nodes")
+	}
+
+	net.Close()
+	cl.snodes.mtx.Lock()
+	cl.snodes.nextUpdateAt = time.Now()
+	cl.snodes.mtx.Unlock()
+	err = cl.Update(context.Background())
+	if err == nil {
+		t.Fatal("refresh against a dead network succeeded")
+	}
+	if len(cl.snodes.All()) != 6 {
+		t.Fatal("failed refresh dropped the old snode list")
+	}
+}
+
+func TestFetchFailsOverWithinSwarm(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+	_, err := alice.SendTo(context.Background(), bob.SessionID(), "hello bob")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	members := net.SwarmFor(bob.SessionID())
+	for idx := 0; idx < net.Len(); idx++ {
+		node := net.Node(idx)
+		if node.Info().IdentityKey != members[0].IdentityKey && node.Info().IdentityKey != members[1].IdentityKey {
+			continue
+		}
+		node.Close()
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+}
+
+func TestFetchFollowsSwarmMove(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+	_, err := alice.SendTo(context.Background(), bob.SessionID(), "hello bob")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	_, err = bob.FetchNewMessages(context.Background())
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+
+	// move bob's swarm onto another swarm id so bob's messages now belong to the remaining swarm
+	old := make(map[string]bool)
+	for _, node := range net.SwarmFor(bob.SessionID()) {
+		old[node.IdentityKey] = true
+	}
+	var moving []*swarmtest.Node
+	others := make(map[uint64]bool)
+	for idx := 0; idx < net.Len(); idx++ {
+		node := net.Node(idx)
+		if old[node.Info().IdentityKey] {
+			moving = append(moving, node)
+		} else {
+			others[node.Info().SwarmID] = true
+		}
+	}
+	moved := false
+	for swarmID := range others {
+		for _, node := range moving {
+			node.SetSwarm(swarmID)
+		}
+		moved = true
+		for _, node := range net.SwarmFor(bob.SessionID()) {
+			moved = moved && !old[node.IdentityKey]
+		}
+		if moved {
+			break
+		}
+	}
+	if !moved {
+		t.Fatal("could not move bob's swarm")
+	}
+
+	_, err = alice.SendTo(context.Background(), bob.SessionID(), "hello again")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil {
+		t.Fatalf("fetch after move failed: %s", err.Error())
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message after move, got %d", len(msgs))
+	}
+	for _, node := range bob.swarms.get(&bob.snodes, bob.SessionID()) {
+		if old[node.IdentityKey] {
+			t.Fatal("swarm cache still holds the old swarm")
+		}
+	}
+}
+
+func TestRedirectToUnknownNodes(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	id := cryptography.Keygen().SessionID()
+	stranger := swarm.ServiceNode{RemoteIP: "10.0.0.1", StoragePort: 443, IdentityKey: strings.Repeat("ab", 32)}
+
+	members := alice.followRedirect(id, []swarm.ServiceNode{stranger})
+	if !sameNodes(members, alice.snodes.SwarmFor(id)) {
+		t.Fatalf("redirect to unknown nodes not resolved from our snode list: %+v", members)
+	}
+	if _, cached := alice.swarms.swarms[id]; cached {
+		t.Fatal("redirect to unknown nodes was cached")
+	}
+
+	known := net.Node(0).Info()
+	spoofed := known
+	spoofed.RemoteIP = "10.0.0.2"
+	members = alice.followRedirect(id, []swarm.ServiceNode{stranger, spoofed})
+	if len(members) != 1 || members[0].IdentityKey != known.IdentityKey || members[0].RemoteIP != known.RemoteIP {
+		t.Fatalf("expected only our entry for the known node, got %+v", members)
+	}
+	if cached := alice.swarms.get(&alice.snodes, id); !sameNodes(cached, members) {
+		t.Fatalf("known redirect not cached: %+v", cached)
+	}
+}
+
+func TestSendQuorum(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+	result, err := alice.SendTo(context.Background(), bob.SessionID(), "hello bob")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+	if result.Accepted != 3 || result.Attempted != 3 {
+		t.Fatalf("expected all 3 members to accept, got %+v", result)
+	}
+
+	members := net.SwarmFor(bob.SessionID())
+	for idx := 0; idx < net.Len(); idx++ {
+		node := net.Node(idx)
+		if node.Info().IdentityKey == members[0].IdentityKey || node.Info().IdentityKey == members[1].IdentityKey {
+			node.Close()
+		}
+	}
+	result, err = alice.SendTo(context.Background(), bob.SessionID(), "one node left")
+	if err != nil {
+		t.Fatalf("send with quorum 1 failed: %s", err.Error())
+	}
+	if result.Accepted != 1 || len(result.Errors) != 2 {
+		t.Fatalf("expected 1 accepted and 2 errors, got %+v", result)
+	}
+
+	alice.opts.StoreQuorum = 2
+	result, err = alice.SendTo(context.Background(), bob.SessionID(), "not enough nodes")
+	if !errors.Is(err, ErrQuorumNotReached) {
+		t.Fatalf("expected quorum error, got %v", err)
+	}
+	if result.Accepted != 1 {
+		t.Fatalf("expected 1 accepted, got %+v", result)
+	}
+}
+
+/// racingStore never reports a message as known, like a store shared with another process that stores it between our check and our insert
+type racingStore struct {
+	*memStore
+}
+
+func (racingStore) HasMessage(string) bool {
+	return false
+}
+
+func TestSharedStoreDeliversOnce(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 3)
+	defer net.Close()
+	alice := newTestClient(t, net)
+	keys := cryptography.Keygen()
+	store := racingStore{MemoryStore().(*memStore)}
+	opts := &ClientOptions{SeedNodes: []swarm.ServiceNode{net.Seed()}}
+	first := NewClient(keys, store, opts)
+	second := NewClient(keys, store, opts)
+	for _, cl := range []*Client{first, second} {
+		err := cl.Update(context.Background())
+		if err != nil {
+			t.Fatalf("update failed: %s", err.Error())
+		}
+	}
+	_, err := alice.SendTo(context.Background(), first.SessionID(), "only once")
+	if err != nil {
+		t.Fatalf("send failed: %s", err.Error())
+	}
+
+	var delivered int
+	for _, cl := range []*Client{first, second} {
+		msgs, err := cl.FetchNewMessages(context.Background())
+		if err != nil {
+			t.Fatalf("fetch failed: %s", err.Error())
+		}
+		delivered += len(msgs)
+	}
+	if delivered != 1 {
+		t.Fatalf("message delivered %d times", delivered)
+	}
+	history, err := first.History(HistoryQuery{})
+	if err != nil || len(history) != 1 {
+		t.Fatalf("expected one history entry, got %+v %v", history, err)
+	}
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/majestrate/ubw/lib/model"
+	"time"
+)
+
+/// ErrNoHistory is returned by history queries when the client's store does not keep conversations
+var ErrNoHistory = errors.New("message store does not keep conversation history")
+
+/// defaultHistoryLimit is how many messages a history query returns when it sets no limit
+const defaultHistoryLimit = 50
+
+/// Direction says whether a conversation message was sent or received by us
+type Direction int
+
+const (
+	Incoming Direction = iota
+	Outgoing
+)
+
+func (d Direction) String() string {
+	if d == Outgoing {
+		return "outgoing"
+	}
+	return "incoming"
+}
+
+/// ConversationMessage is a decrypted message kept in our history
+type ConversationMessage struct {
+	/// ID is the server hash of a received message or the id of a sent one
+	ID string
+	/// Owner is the session id of the client whose history this is
+	Owner string
+	/// Thread is the session id of the other side of the conversation
+	Thread    string
+	From      string
+	Direction Direction
+	Body      string
+	/// SentAt is the sender's timestamp, StoredAt is when we recorded the message
+	SentAt   time.Time
+	StoredAt time.Time
+}
+
+/// HistoryQuery selects conversation messages newest first, zero fields match everything
+type HistoryQuery struct {
+	/// Owner is the session id whose history is searched, it always has to match
+	Owner  string
+	Thread string
+	/// Since only matches messages sent at or after it
+	Since time.Time
+	/// Search only matches messages whose body contains it, ignoring case
+	Search string
+	/// Limit and Offset page through the results, Limit defaults to 50
+	Limit  int
+	Offset int
+}
+
+func (q HistoryQuery) limit() int {
+	if q.Limit > 0 {
+		return q.Limit
+	}
+	return defaultHistoryLimit
+}
+
+/// ConversationStore keeps decrypted messages so they can be queried later
+type ConversationStore interface {
+	/// PutConversation records msg, recording the same ID twice keeps the first
+	PutConversation(msg ConversationMessage) error
+	History(q HistoryQuery) ([]ConversationMessage, error)
+	/// PruneHistory removes owner's messages sent before sentBefore
+	PruneHistory(owner string, sentBefore time.Time) (int, error)
+}
+
+/// rawID names a sent message by its ciphertext, as we do not learn its server hash
+func rawID(raw []byte) string {
+	digest := sha256.Sum256(raw)
+	return hex.EncodeToString(digest[:])
+}
+
+/// recordConversation adds a decrypted message with a body to our history if the store keeps one
+func (cl *Client) recordConversation(id, thread string, direction Direction, plain *model.PlainMessage) error {
+	history, ok := cl.store.(ConversationStore)
+	body := plain.Body()
+	if !ok || body == nil {
+		return nil
+	}
+	from := plain.From
+	if direction == Outgoing {
+		from = cl.SessionID()
+	}
+	return history.PutConversation(ConversationMessage{
+		ID:        id,
+		Owner:     cl.SessionID(),
+		Thread:    thread,
+		From:      from,
+		Direction: direction,
+		Body:      *body,
+		SentAt:    time.Unix(0, int64(plain.Message.GetTimestamp())*int64(time.Millisecond)),
+		StoredAt:  time.Now(),
+	})
+}
+
+/// History returns our conversation messages matching q, newest first, q.Owner is ignored
+func (cl *Client) History(q HistoryQuery) ([]ConversationMessage, error) {
+	history, ok := cl.store.(ConversationStore)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	q.Owner = cl.SessionID()
+	return history.History(q)
+}
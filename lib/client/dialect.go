@@ -0,0 +1,42 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+)
+
+/// dialect holds what differs between the sql databases we support
+type dialect struct {
+	name string
+	/// numbered is true if placeholders are written $1, $2... instead of ?
+	numbered bool
+	/// lockMigrations is run at the start of every migration transaction so concurrent instances migrate one at a time
+	lockMigrations string
+}
+
+var sqliteDialect = &dialect{name: "sqlite"}
+
+var postgresDialect = &dialect{
+	name:     "postgres",
+	numbered: true,
+	// the key is arbitrary, it only needs to be the same for every instance
+	lockMigrations: "SELECT pg_advisory_xact_lock(7562871)",
+}
+
+/// rebind rewrites the ? placeholders in query for the dialect, queries must not contain a literal ?
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
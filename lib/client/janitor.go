@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"github.com/majestrate/ubw/lib/constants"
+	"github.com/majestrate/ubw/lib/model"
+	"strconv"
+	"time"
+)
+
+const defaultJanitorInterval = 10 * time.Minute
+
+/// tombstoneGrace is how long the hash of an expired message is kept after its ciphertext is dropped, it covers clock skew between us and the network
+const tombstoneGrace = 24 * time.Hour
+
+/// expiration returns when the network drops msg in milliseconds, messages without one expire a TTL after their timestamp
+func expiration(msg model.Message) string {
+	if msg.Expiration != "" || msg.Timestamp == "" {
+		return msg.Expiration
+	}
+	return strconv.FormatInt(millis(msg.Timestamp)+constants.TTLMillis, 10)
+}
+
+/// Prune drops stored messages the network no longer keeps and our history older than HistoryRetention, returning how many were pruned
+func (cl *Client) Prune(now time.Time) (pruned int, err error) {
+	if !cl.opts.KeepRawMessages {
+		pruned, err = cl.store.PruneExpired(now, now.Add(-tombstoneGrace))
+		if err != nil {
+			return
+		}
+	}
+	history, ok := cl.store.(ConversationStore)
+	if ok && cl.opts.HistoryRetention > 0 {
+		var n int
+		n, err = history.PruneHistory(cl.SessionID(), now.Add(-cl.opts.HistoryRetention))
+		pruned += n
+	}
+	return
+}
+
+/// RunJanitor prunes the store every JanitorInterval until ctx is done, onError is called with failed prunes and may be nil
+func (cl *Client) RunJanitor(ctx context.Context, onError func(error)) {
+	for {
+		_, err := cl.Prune(time.Now())
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cl.opts.janitorInterval()):
+		}
+	}
+}
@@ -2,40 +2,194 @@ package client
 
 import "github.com/majestrate/ubw/lib/model"
 
-import "strconv"
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
+/// mailboxHead is the newest message seen in one mailbox
+type mailboxHead struct {
+	timestamp int64
+	hash      string
+}
+
+/// memStore keeps everything in memory, it is safe for concurrent use
 type memStore struct {
-	lastTimestamp int64
-	lastHash      string
-	msgs          map[string]model.Message
+	mtx      sync.RWMutex
+	heads    map[string]mailboxHead
+	msgs     map[string]model.Message
+	outgoing map[string]OutgoingMessage
+	history  []ConversationMessage
 }
 
 func (m *memStore) HasMessage(hash string) bool {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 	_, ok := m.msgs[hash]
 	return ok
 }
 
-func (m *memStore) Put(msg model.Message) error {
+func (m *memStore) Put(msg model.Message) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.msgs[msg.Hash]; ok {
+		return false, nil
+	}
 	t, _ := strconv.ParseInt(msg.Timestamp, 10, 64)
 	m.msgs[msg.Hash] = msg
-	if m.lastTimestamp < t {
-		m.lastHash = msg.Hash
-		m.lastTimestamp = t
+	if head, ok := m.heads[msg.Owner]; !ok || head.timestamp < t {
+		m.heads[msg.Owner] = mailboxHead{timestamp: t, hash: msg.Hash}
+	}
+	return true, nil
+}
+
+func (m *memStore) LastHash(pubkey string) string {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.heads[pubkey].hash
+}
+
+func (m *memStore) PruneExpired(expiredBefore, forgetBefore time.Time) (pruned int, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for hash, msg := range m.msgs {
+		expiration := millis(msg.Expiration)
+		if expiration == 0 {
+			continue
+		}
+		if expiration < toMillis(forgetBefore) {
+			delete(m.msgs, hash)
+			pruned++
+		} else if expiration < toMillis(expiredBefore) && msg.Raw != nil {
+			msg.Raw = nil
+			m.msgs[hash] = msg
+			pruned++
+		}
+	}
+	return
+}
+
+func (m *memStore) PutOutgoing(msg OutgoingMessage) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if existing, ok := m.outgoing[msg.ID]; ok && existing.Owner != msg.Owner {
+		return nil
+	}
+	msg.ClaimedUntil = time.Time{}
+	m.outgoing[msg.ID] = msg
+	return nil
+}
+
+func (m *memStore) Outgoing(owner string) (msgs []OutgoingMessage, err error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for _, msg := range m.outgoing {
+		if msg.Owner == owner {
+			msgs = append(msgs, msg)
+		}
+	}
+	return
+}
+
+func (m *memStore) ClaimOutgoing(owner string, now time.Time, lease time.Duration, n int) (claimed []OutgoingMessage, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for id, msg := range m.outgoing {
+		if len(claimed) >= n {
+			break
+		}
+		if msg.Owner != owner || now.Before(msg.NextAttempt) || now.Before(msg.ClaimedUntil) {
+			continue
+		}
+		msg.ClaimedUntil = now.Add(lease)
+		m.outgoing[id] = msg
+		claimed = append(claimed, msg)
+	}
+	return
+}
+
+func (m *memStore) DeleteOutgoing(owner, id string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.outgoing[id].Owner == owner {
+		delete(m.outgoing, id)
+	}
+	return nil
+}
+
+func (m *memStore) PutConversation(msg ConversationMessage) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, existing := range m.history {
+		if existing.ID == msg.ID {
+			return nil
+		}
 	}
+	m.history = append(m.history, msg)
 	return nil
 }
 
-func (m *memStore) LastHash() string {
-	return m.lastHash
+func (m *memStore) History(q HistoryQuery) (found []ConversationMessage, err error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	search := strings.ToLower(q.Search)
+	for _, msg := range m.history {
+		if msg.Owner != q.Owner || q.Thread != "" && msg.Thread != q.Thread {
+			continue
+		}
+		if msg.SentAt.Before(q.Since) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(msg.Body), search) {
+			continue
+		}
+		found = append(found, msg)
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].SentAt.After(found[j].SentAt)
+	})
+	if q.Offset >= len(found) {
+		return nil, nil
+	}
+	found = found[q.Offset:]
+	if len(found) > q.limit() {
+		found = found[:q.limit()]
+	}
+	return
+}
+
+func (m *memStore) PruneHistory(owner string, sentBefore time.Time) (pruned int, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	var keep []ConversationMessage
+	for _, msg := range m.history {
+		if msg.Owner == owner && msg.SentAt.Before(sentBefore) {
+			pruned++
+		} else {
+			keep = append(keep, msg)
+		}
+	}
+	m.history = keep
+	return
 }
 
 func (m *memStore) Close() error {
-	m.lastHash = ""
-	m.lastTimestamp = 0
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.heads = make(map[string]mailboxHead)
 	m.msgs = make(map[string]model.Message)
+	m.outgoing = make(map[string]OutgoingMessage)
+	m.history = nil
 	return nil
 }
 
 func MemoryStore() MessageStore {
-	return &memStore{msgs: make(map[string]model.Message)}
+	return &memStore{
+		heads:    make(map[string]mailboxHead),
+		msgs:     make(map[string]model.Message),
+		outgoing: make(map[string]OutgoingMessage),
+	}
 }
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+/// migration upgrades a database schema by one version
+type migration struct {
+	version int
+	name    string
+	stmts   []string
+	/// postgres replaces stmts on postgres, where the types differ and there are no databases from before versioning
+	postgres []string
+}
+
+func (m migration) statements(d *dialect) []string {
+	if d == postgresDialect && m.postgres != nil {
+		return m.postgres
+	}
+	return m.stmts
+}
+
+/// sqlMigrations are applied in order, a migration must never change once released, add a new one instead
+var sqlMigrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		stmts: []string{
+			// databases from before versioning already have these tables
+			"CREATE TABLE IF NOT EXISTS messages(hash BLOB PRIMARY KEY, contents BLOB NOT NULL, timestamp DATETIME)",
+			"CREATE TABLE IF NOT EXISTS outbox(id TEXT PRIMARY KEY, recipient TEXT NOT NULL, contents BLOB NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, last_error TEXT NOT NULL DEFAULT '', next_attempt INTEGER NOT NULL, deadline INTEGER NOT NULL)",
+		},
+		postgres: []string{
+			"CREATE TABLE messages(hash TEXT PRIMARY KEY, contents BYTEA NOT NULL)",
+			"CREATE TABLE outbox(id TEXT PRIMARY KEY, recipient TEXT NOT NULL, contents BYTEA NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, last_error TEXT NOT NULL DEFAULT '', next_attempt BIGINT NOT NULL, deadline BIGINT NOT NULL)",
+		},
+	},
+	{
+		version: 2,
+		name:    "store server metadata with messages",
+		stmts: []string{
+			`CREATE TABLE messages_v2(
+hash TEXT PRIMARY KEY,
+contents BLOB NOT NULL,
+owner TEXT NOT NULL DEFAULT '',
+server_timestamp INTEGER NOT NULL DEFAULT 0,
+expiration INTEGER NOT NULL DEFAULT 0,
+sender TEXT NOT NULL DEFAULT '',
+sent_at INTEGER NOT NULL DEFAULT 0)`,
+			"INSERT INTO messages_v2(hash, contents) SELECT hash, contents FROM messages",
+			"DROP TABLE messages",
+			"ALTER TABLE messages_v2 RENAME TO messages",
+			"CREATE INDEX messages_owner_timestamp ON messages(owner, server_timestamp)",
+		},
+		postgres: []string{
+			`ALTER TABLE messages
+ADD COLUMN owner TEXT NOT NULL DEFAULT '',
+ADD COLUMN server_timestamp BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN expiration BIGINT NOT NULL DEFAULT 0,
+ADD COLUMN sender TEXT NOT NULL DEFAULT '',
+ADD COLUMN sent_at BIGINT NOT NULL DEFAULT 0`,
+			"CREATE INDEX messages_owner_timestamp ON messages(owner, server_timestamp)",
+		},
+	},
+	{
+		version: 3,
+		name:    "conversation history",
+		stmts: []string{
+			`CREATE TABLE conversations(
+id TEXT PRIMARY KEY,
+thread TEXT NOT NULL,
+sender TEXT NOT NULL,
+direction INTEGER NOT NULL,
+body TEXT NOT NULL,
+sent_at INTEGER NOT NULL,
+stored_at INTEGER NOT NULL)`,
+			"CREATE INDEX conversations_thread_sent_at ON conversations(thread, sent_at)",
+			"CREATE INDEX conversations_sent_at ON conversations(sent_at)",
+		},
+		postgres: []string{
+			`CREATE TABLE conversations(
+id TEXT PRIMARY KEY,
+thread TEXT NOT NULL,
+sender TEXT NOT NULL,
+direction INTEGER NOT NULL,
+body TEXT NOT NULL,
+sent_at BIGINT NOT NULL,
+stored_at BIGINT NOT NULL)`,
+			"CREATE INDEX conversations_thread_sent_at ON conversations(thread, sent_at)",
+			"CREATE INDEX conversations_sent_at ON conversations(sent_at)",
+		},
+	},
+	{
+		version: 4,
+		name:    "scope outbox and history to their owner",
+		// rows from before this migration are left without an owner until a client adopts them
+		stmts: []string{
+			"ALTER TABLE outbox ADD COLUMN owner TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE outbox ADD COLUMN claim TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE outbox ADD COLUMN claimed_until INTEGER NOT NULL DEFAULT 0",
+			"CREATE INDEX outbox_owner_next_attempt ON outbox(owner, next_attempt)",
+			"ALTER TABLE conversations ADD COLUMN owner TEXT NOT NULL DEFAULT ''",
+			"DROP INDEX conversations_thread_sent_at",
+			"DROP INDEX conversations_sent_at",
+			"CREATE INDEX conversations_owner_thread_sent_at ON conversations(owner, thread, sent_at)",
+			"CREATE INDEX conversations_owner_sent_at ON conversations(owner, sent_at)",
+		},
+		postgres: []string{
+			`ALTER TABLE outbox
+ADD COLUMN owner TEXT NOT NULL DEFAULT '',
+ADD COLUMN claim TEXT NOT NULL DEFAULT '',
+ADD COLUMN claimed_until BIGINT NOT NULL DEFAULT 0`,
+			"CREATE INDEX outbox_owner_next_attempt ON outbox(owner, next_attempt)",
+			"ALTER TABLE conversations ADD COLUMN owner TEXT NOT NULL DEFAULT ''",
+			"DROP INDEX conversations_thread_sent_at",
+			"DROP INDEX conversations_sent_at",
+			"CREATE INDEX conversations_owner_thread_sent_at ON conversations(owner, thread, sent_at)",
+			"CREATE INDEX conversations_owner_sent_at ON conversations(owner, sent_at)",
+		},
+	},
+	{
+		version: 5,
+		name:    "store settings",
+		stmts: []string{
+			"CREATE TABLE store_settings(name TEXT PRIMARY KEY, value TEXT NOT NULL)",
+		},
+	},
+}
+
+/// queryer is a *sql.DB or *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+/// schemaVersion returns the version of the newest migration applied, 0 if none are
+func schemaVersion(db queryer) (version int, err error) {
+	var v sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&v)
+	return int(v.Int64), err
+}
+
+/// migrate applies every migration newer than the database's schema version, each in its own transaction
+func migrate(db *sql.DB, d *dialect, migrations []migration) error {
+	for _, m := range migrations {
+		err := applyMigration(db, d, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %s", m.version, m.name, err.Error())
+		}
+	}
+	return nil
+}
+
+/// applyMigration applies m unless the database already has it, the version is read under the migration lock so instances starting together apply it once
+func applyMigration(db *sql.DB, d *dialect, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if d.lockMigrations != "" {
+		_, err = tx.Exec(d.lockMigrations)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_version(version INTEGER NOT NULL)")
+	if err != nil {
+		return fmt.Errorf("could not create schema version table: %s", err.Error())
+	}
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return fmt.Errorf("could not read schema version: %s", err.Error())
+	}
+	if current >= m.version {
+		return nil
+	}
+	for _, stmt := range m.statements(d) {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO schema_version(version) VALUES(?)"), m.version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"github.com/majestrate/ubw/lib/attachments"
+	"github.com/majestrate/ubw/lib/swarm"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
+	"time"
+)
+
+/// ClientOptions holds optional settings for NewClient, the zero value uses the defaults
+type ClientOptions struct {
+	/// SeedNodes are used to bootstrap the snode list, if empty the seeds in $UBW_SEED_NODES or the built in seeds are used
+	SeedNodes []swarm.ServiceNode
+	/// OnionRequests sends storage requests through onion paths so service nodes do not learn our ip
+	OnionRequests bool
+	/// NumPaths is how many onion paths to keep built, defaults to 2
+	NumPaths int
+	/// PathLifetime is how long an onion path is used before it is rebuilt, defaults to 10 minutes
+	PathLifetime time.Duration
+	/// RequestTimeout bounds each request to a service node, defaults to 30 seconds
+	RequestTimeout time.Duration
+	/// HTTP tunes the http client shared by every service node request
+	HTTP *rpc.HTTPOptions
+	/// InsecureSkipVerify allows seed nodes given by ip without an identity key, their certificates cannot be checked so only use this on private devnets
+	InsecureSkipVerify bool
+	/// PinIdentities checks service node certificates against their identity keys, oxen storage servers do not support this so only use it on networks that do, see rpc.Pinner
+	PinIdentities bool
+	/// Middleware wraps every rpc made to a service node, for retries or logging
+	Middleware []rpc.Middleware
+	/// StoreCopies is how many swarm members each sent message is stored on at once, defaults to 3
+	StoreCopies int
+	/// StoreQuorum is how many swarm members must accept a message for a send to succeed, defaults to 1
+	StoreQuorum int
+	/// OutboxDeadline is how long a queued message is retried before it is given up on, defaults to 24 hours
+	OutboxDeadline time.Duration
+	/// OutboxRetryDelay is the wait after a queued message's first failed send, it doubles with every failure up to 10 minutes, defaults to 5 seconds
+	OutboxRetryDelay time.Duration
+	/// PollInterval is how often Subscribe polls our swarm for new messages, defaults to 5 seconds
+	PollInterval time.Duration
+	/// MaxPollDelay caps how far Subscribe backs off while polls fail, defaults to 1 minute
+	MaxPollDelay time.Duration
+	/// KeepRawMessages keeps the ciphertext of messages after the network has dropped them, by default the janitor drops it
+	KeepRawMessages bool
+	/// HistoryRetention is how long decrypted conversation history is kept, 0 keeps it forever
+	HistoryRetention time.Duration
+	/// JanitorInterval is how often RunJanitor prunes the store, defaults to 10 minutes
+	JanitorInterval time.Duration
+	/// FileServer fetches and stores attachments, by default attachment urls are only fetched over https from attachments.DefaultFileServerHosts
+	/// and uploads go to attachments.DefaultFileServer
+	FileServer attachments.FileServer
+	/// MaxAttachmentSize is the largest attachment Download fetches or Upload sends in bytes, defaults to attachments.DefaultMaxSize
+	MaxAttachmentSize int64
+}
+
+const defaultRequestTimeout = 30 * time.Second
+
+func (opts *ClientOptions) requestTimeout() time.Duration {
+	if opts.RequestTimeout > 0 {
+		return opts.RequestTimeout
+	}
+	return defaultRequestTimeout
+}
+
+func (opts *ClientOptions) janitorInterval() time.Duration {
+	if opts.JanitorInterval > 0 {
+		return opts.JanitorInterval
+	}
+	return defaultJanitorInterval
+}
+
+func (opts *ClientOptions) pollInterval() time.Duration {
+	if opts.PollInterval > 0 {
+		return opts.PollInterval
+	}
+	return defaultPollInterval
+}
+
+func (opts *ClientOptions) maxPollDelay() time.Duration {
+	if opts.MaxPollDelay > 0 {
+		return opts.MaxPollDelay
+	}
+	return defaultMaxPollDelay
+}
+
+func (opts *ClientOptions) outboxDeadline() time.Duration {
+	if opts.OutboxDeadline > 0 {
+		return opts.OutboxDeadline
+	}
+	return defaultOutboxDeadline
+}
+
+func (opts *ClientOptions) outboxRetryDelay() time.Duration {
+	if opts.OutboxRetryDelay > 0 {
+		return opts.OutboxRetryDelay
+	}
+	return defaultOutboxRetryDelay
+}
+
+func (opts *ClientOptions) storeQuorum() int {
+	if opts.StoreQuorum > 0 {
+		return opts.StoreQuorum
+	}
+	return defaultStoreQuorum
+}
+
+/// storeCopies is never less than the quorum, or the quorum could not be reached
+func (opts *ClientOptions) storeCopies() int {
+	copies := defaultStoreCopies
+	if opts.StoreCopies > 0 {
+		copies = opts.StoreCopies
+	}
+	if quorum := opts.storeQuorum(); copies < quorum {
+		return quorum
+	}
+	return copies
+}
+
+func (opts *ClientOptions) numPaths() int {
+	if opts.NumPaths > 0 {
+		return opts.NumPaths
+	}
+	return defaultNumPaths
+}
+
+func (opts *ClientOptions) pathLifetime() time.Duration {
+	if opts.PathLifetime > 0 {
+		return opts.PathLifetime
+	}
+	return defaultPathLifetime
+}
+
+func (opts *ClientOptions) seedNodes() ([]swarm.ServiceNode, error) {
+	if len(opts.SeedNodes) > 0 {
+		return opts.SeedNodes, nil
+	}
+	nodes, err := swarm.SeedNodesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) > 0 {
+		return nodes, nil
+	}
+	return swarm.DefaultSeedNodes(), nil
+}
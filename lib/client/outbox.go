@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/majestrate/ubw/lib/model"
+	"time"
+)
+
+const defaultOutboxDeadline = 24 * time.Hour
+const defaultOutboxRetryDelay = 5 * time.Second
+const maxOutboxRetryDelay = 10 * time.Minute
+
+/// outboxClaimLease is how long a claimed message is left to the instance sending it before another may try it
+const outboxClaimLease = 5 * time.Minute
+
+/// Delivery is the final outcome of a queued message, Err is nil if it was delivered
+type Delivery struct {
+	Message OutgoingMessage
+	Result  *SendResult
+	Err     error
+}
+
+/// Queue encrypts body for dst and puts it in the outbox, RunOutbox sends it and retries until it is delivered or its deadline passes
+func (cl *Client) Queue(dst, body string) (*OutgoingMessage, error) {
+	return cl.QueueMessage(dst, cl.makePlain(body))
+}
+
+/// QueueReply is ReplyTo through the outbox
+func (cl *Client) QueueReply(orig *model.PlainMessage, body string) (*OutgoingMessage, error) {
+	return cl.QueueMessage(orig.From, model.NewMessage().Body(body).ReplyTo(orig).Build())
+}
+
+/// QueueMessage is Queue for a message built with model.NewMessage
+func (cl *Client) QueueMessage(dst string, plain *model.PlainMessage) (*OutgoingMessage, error) {
+	raw, err := plain.Encrypt(cl.keys, dst)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	msg := OutgoingMessage{
+		ID:          id,
+		Owner:       cl.SessionID(),
+		To:          dst,
+		Raw:         raw,
+		NextAttempt: now,
+		Deadline:    now.Add(cl.opts.outboxDeadline()),
+	}
+	err = cl.store.PutOutgoing(msg)
+	if err != nil {
+		return nil, err
+	}
+	// queued messages go in the history right away so a conversation reads in order
+	err = cl.recordConversation(msg.ID, dst, Outgoing, plain)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case cl.outboxWake <- struct{}{}:
+	default:
+	}
+	return &msg, nil
+}
+
+/// RunOutbox sends queued messages until ctx is done, including any left over from before a restart
+/// onDelivery is called once for every message that is delivered or given up on and may be nil
+func (cl *Client) RunOutbox(ctx context.Context, onDelivery func(Delivery)) {
+	for {
+		next := cl.sendQueued(ctx, onDelivery)
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			wait = time.After(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-cl.outboxWake:
+		case <-wait:
+		}
+	}
+}
+
+/// retryDelay is how long to wait after a message failed attempts times
+func (cl *Client) retryDelay(attempts int) time.Duration {
+	delay := cl.opts.outboxRetryDelay()
+	for try := 1; try < attempts && delay < maxOutboxRetryDelay; try++ {
+		delay *= 2
+	}
+	if delay > maxOutboxRetryDelay {
+		return maxOutboxRetryDelay
+	}
+	return delay
+}
+
+/// sendQueued claims and sends our due messages one at a time, so other instances sharing the store never send the same one, and returns when the next one is due or the zero time if the outbox is empty
+func (cl *Client) sendQueued(ctx context.Context, onDelivery func(Delivery)) (next time.Time) {
+	cl.outboxMtx.Lock()
+	defer cl.outboxMtx.Unlock()
+	owner := cl.SessionID()
+	started := time.Now()
+	for ctx.Err() == nil {
+		msgs, err := cl.store.ClaimOutgoing(owner, time.Now(), outboxClaimLease, 1)
+		if err != nil {
+			return time.Now().Add(cl.opts.outboxRetryDelay())
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		if msgs[0].NextAttempt.After(started) {
+			// it already failed in this pass, hand it back for the next one
+			cl.store.PutOutgoing(msgs[0])
+			break
+		}
+		cl.sendClaimed(ctx, msgs[0], onDelivery)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	msgs, err := cl.store.Outgoing(owner)
+	if err != nil {
+		return time.Now().Add(cl.opts.outboxRetryDelay())
+	}
+	for _, msg := range msgs {
+		due := msg.NextAttempt
+		if msg.ClaimedUntil.After(due) {
+			due = msg.ClaimedUntil
+		}
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return
+}
+
+/// sendClaimed makes one attempt at sending a claimed message, the attempt is cut off before the claim runs out
+func (cl *Client) sendClaimed(ctx context.Context, msg OutgoingMessage, onDelivery func(Delivery)) {
+	sendCtx, cancel := context.WithTimeout(ctx, outboxClaimLease/2)
+	result, err := cl.send(sendCtx, msg.To, model.Message{Raw: msg.Raw})
+	cancel()
+	if ctx.Err() != nil {
+		// put it back as it was so it is due again as soon as the outbox runs
+		cl.store.PutOutgoing(msg)
+		return
+	}
+	deliver := func(delivery Delivery) {
+		if cl.store.DeleteOutgoing(msg.Owner, msg.ID) == nil && onDelivery != nil {
+			onDelivery(delivery)
+		}
+	}
+	msg.Attempts++
+	if err == nil {
+		deliver(Delivery{Message: msg, Result: result})
+		return
+	}
+	now := time.Now()
+	msg.LastError = err.Error()
+	if !now.Before(msg.Deadline) {
+		deliver(Delivery{Message: msg, Result: result, Err: err})
+		return
+	}
+	msg.NextAttempt = now.Add(cl.retryDelay(msg.Attempts))
+	if msg.NextAttempt.After(msg.Deadline) {
+		msg.NextAttempt = msg.Deadline
+	}
+	// if this fails the message stays claimed and is retried once the claim runs out
+	cl.store.PutOutgoing(msg)
+}
+
+/// randomID makes a random hex id
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"context"
+	"database/sql"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"github.com/majestrate/ubw/lib/swarm"
+	"github.com/majestrate/ubw/lib/swarm/swarmtest"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) MessageStore {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("could not open database: %s", err.Error())
+	}
+	store, err := SQLStore(db)
+	if err != nil {
+		t.Fatalf("could not open store: %s", err.Error())
+	}
+	return store
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+	bob := newTestClient(t, net)
+
+	path := filepath.Join(t.TempDir(), "messages.db")
+	keys := cryptography.Keygen()
+	opts := &ClientOptions{
+		SeedNodes:        []swarm.ServiceNode{net.Seed()},
+		OutboxRetryDelay: time.Millisecond,
+	}
+	store := openTestStore(t, path)
+	alice := NewClient(keys, store, opts)
+	// no snode list yet, so the first attempt fails
+	_, err := alice.Queue(bob.SessionID(), "hello later")
+	if err != nil {
+		t.Fatalf("queue failed: %s", err.Error())
+	}
+	var deliveries []Delivery
+	onDelivery := func(d Delivery) {
+		deliveries = append(deliveries, d)
+	}
+	alice.sendQueued(context.Background(), onDelivery)
+	if len(deliveries) != 0 {
+		t.Fatalf("message delivered without a snode list: %+v", deliveries)
+	}
+	store.Close()
+
+	store = openTestStore(t, path)
+	defer store.Close()
+	pending, err := store.Outgoing(keys.SessionID())
+	if err != nil || len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("queued message not persisted: %+v %v", pending, err)
+	}
+	alice = NewClient(keys, store, opts)
+	err = alice.Update(context.Background())
+	if err != nil {
+		t.Fatalf("update failed: %s", err.Error())
+	}
+	time.Sleep(2 * time.Millisecond)
+	alice.sendQueued(context.Background(), onDelivery)
+	if len(deliveries) != 1 || deliveries[0].Err != nil || deliveries[0].Result.Accepted == 0 {
+		t.Fatalf("expected one successful delivery, got %+v", deliveries)
+	}
+	pending, _ = store.Outgoing(keys.SessionID())
+	if len(pending) != 0 {
+		t.Fatalf("delivered message still queued: %+v", pending)
+	}
+	msgs, err := bob.FetchNewMessages(context.Background())
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected 1 message for bob, got %d %v", len(msgs), err)
+	}
+}
+
+func TestOutboxDeadline(t *testing.T) {
+	alice := NewClient(cryptography.Keygen(), nil, &ClientOptions{
+		OutboxDeadline:   time.Millisecond,
+		OutboxRetryDelay: time.Millisecond,
+	})
+	_, err := alice.Queue(cryptography.Keygen().SessionID(), "nobody home")
+	if err != nil {
+		t.Fatalf("queue failed: %s", err.Error())
+	}
+	var deliveries []Delivery
+	for try := 0; try < 5 && len(deliveries) == 0; try++ {
+		time.Sleep(time.Millisecond)
+		alice.sendQueued(context.Background(), func(d Delivery) {
+			deliveries = append(deliveries, d)
+		})
+	}
+	if len(deliveries) != 1 || deliveries[0].Err == nil {
+		t.Fatalf("expected one failed delivery, got %+v", deliveries)
+	}
+}
+
+func TestClaimOutgoing(t *testing.T) {
+	eachStore(t, func(t *testing.T, store MessageStore) {
+		now := time.Now()
+		for _, msg := range []OutgoingMessage{
+			{ID: "a1", Owner: "05aa", NextAttempt: now.Add(-time.Second)},
+			{ID: "a2", Owner: "05aa", NextAttempt: now.Add(-time.Second)},
+			{ID: "a3", Owner: "05aa", NextAttempt: now.Add(time.Hour)},
+			{ID: "b1", Owner: "05bb", NextAttempt: now.Add(-time.Second)},
+		} {
+			msg.Raw = []byte(msg.ID)
+			err := store.PutOutgoing(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		pending, err := store.Outgoing("05aa")
+		if err != nil || len(pending) != 3 {
+			t.Fatalf("expected 3 queued messages for 05aa, got %+v %v", pending, err)
+		}
+
+		first, err := store.ClaimOutgoing("05aa", now, time.Minute, 1)
+		if err != nil || len(first) != 1 || first[0].Owner != "05aa" {
+			t.Fatalf("first claim got %+v %v", first, err)
+		}
+		second, err := store.ClaimOutgoing("05aa", now, time.Minute, 10)
+		if err != nil || len(second) != 1 || second[0].ID == first[0].ID || second[0].ID == "a3" {
+			t.Fatalf("second claim got %+v %v", second, err)
+		}
+		none, err := store.ClaimOutgoing("05aa", now, time.Minute, 10)
+		if err != nil || len(none) != 0 {
+			t.Fatalf("claimed rows handed out again: %+v %v", none, err)
+		}
+
+		// the other owner's row is neither touched nor deletable by us
+		err = store.DeleteOutgoing("05aa", "b1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs, err := store.ClaimOutgoing("05bb", now, time.Minute, 10)
+		if err != nil || len(theirs) != 1 || theirs[0].ID != "b1" {
+			t.Fatalf("05bb claimed %+v %v", theirs, err)
+		}
+
+		// putting a message back releases its claim, an expired lease does too
+		err = store.PutOutgoing(first[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := store.ClaimOutgoing("05aa", now.Add(2*time.Minute), time.Minute, 10)
+		if err != nil || len(again) != 2 {
+			t.Fatalf("expected released and expired claims back, got %+v %v", again, err)
+		}
+	})
+}
+
+func TestSharedOutbox(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+	bob := newTestClient(t, net)
+	store := openTestStore(t, filepath.Join(t.TempDir(), "messages.db"))
+	defer store.Close()
+	opts := &ClientOptions{SeedNodes: []swarm.ServiceNode{net.Seed()}}
+	alice := NewClient(cryptography.Keygen(), store, opts)
+	carol := NewClient(cryptography.Keygen(), store, opts)
+	for _, cl := range []*Client{alice, carol} {
+		err := cl.Update(context.Background())
+		if err != nil {
+			t.Fatalf("update failed: %s", err.Error())
+		}
+		_, err = cl.Queue(bob.SessionID(), "hello from "+cl.SessionID())
+		if err != nil {
+			t.Fatalf("queue failed: %s", err.Error())
+		}
+	}
+
+	var deliveries []Delivery
+	alice.sendQueued(context.Background(), func(d Delivery) {
+		deliveries = append(deliveries, d)
+	})
+	if len(deliveries) != 1 || deliveries[0].Err != nil {
+		t.Fatalf("expected alice to send only their own message, got %+v", deliveries)
+	}
+	pending, err := store.Outgoing(carol.SessionID())
+	if err != nil || len(pending) != 1 || pending[0].Attempts != 0 {
+		t.Fatalf("carol's message was touched by alice: %+v %v", pending, err)
+	}
+	history, err := alice.History(HistoryQuery{})
+	if err != nil || len(history) != 1 || history[0].Body != "hello from "+alice.SessionID() {
+		t.Fatalf("alice sees someone else's history: %+v %v", history, err)
+	}
+}
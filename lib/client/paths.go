@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/majestrate/ubw/lib/swarm"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/// PathLength is the number of hops in an onion path
+const PathLength = 3
+
+const defaultNumPaths = 2
+const defaultPathLifetime = 10 * time.Minute
+
+var ErrNotEnoughSNodes = errors.New("not enough service nodes to build an onion path")
+
+type onionPath struct {
+	hops    swarm.Path
+	builtAt time.Time
+}
+
+/// pathSet holds the onion paths we send storage requests through
+type pathSet struct {
+	mtx      sync.Mutex
+	paths    []*onionPath
+	num      int
+	lifetime time.Duration
+}
+
+func (p *pathSet) contains(hops swarm.Path, node swarm.ServiceNode) bool {
+	for _, hop := range hops {
+		if hop.IdentityKey == node.IdentityKey {
+			return true
+		}
+	}
+	return false
+}
+
+/// build makes a new path of distinct nodes from snodes that does not include exclude, preferring healthy nodes
+func (p *pathSet) build(snodes *SnodeMap, exclude swarm.ServiceNode) (*onionPath, error) {
+	var hops swarm.Path
+	for _, node := range snodes.RandomN(len(snodes.All())) {
+		if node.IdentityKey == exclude.IdentityKey || p.contains(hops, node) {
+			continue
+		}
+		hops = append(hops, node)
+		if len(hops) == PathLength {
+			return &onionPath{hops: hops, builtAt: time.Now()}, nil
+		}
+	}
+	return nil, ErrNotEnoughSNodes
+}
+
+/// rotate drops paths that are older than the path lifetime
+func (p *pathSet) rotate() {
+	var keep []*onionPath
+	for _, path := range p.paths {
+		if time.Since(path.builtAt) < p.lifetime {
+			keep = append(keep, path)
+		}
+	}
+	p.paths = keep
+}
+
+/// pick returns a random path to reach dst with, building new paths as needed
+func (p *pathSet) pick(snodes *SnodeMap, dst swarm.ServiceNode) (*onionPath, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.rotate()
+	for len(p.paths) < p.num {
+		path, err := p.build(snodes, dst)
+		if err != nil {
+			return nil, err
+		}
+		p.paths = append(p.paths, path)
+	}
+	var usable []*onionPath
+	for _, path := range p.paths {
+		if !p.contains(path.hops, dst) {
+			usable = append(usable, path)
+		}
+	}
+	if len(usable) == 0 {
+		return p.build(snodes, dst)
+	}
+	return usable[rand.Intn(len(usable))], nil
+}
+
+/// drop removes a path that failed so it is not used again
+func (p *pathSet) drop(failed *onionPath) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for idx, path := range p.paths {
+		if path == failed {
+			p.paths = append(p.paths[:idx], p.paths[idx+1:]...)
+			return
+		}
+	}
+}
+
+func (cl *Client) directTransport() *swarm.DirectTransport {
+	return &swarm.DirectTransport{
+		Client:             cl.http,
+		CAClient:           cl.caHTTP,
+		PinIdentities:      cl.opts.PinIdentities,
+		Pins:               cl.pins,
+		InsecureSkipVerify: cl.opts.InsecureSkipVerify,
+		Middleware:         cl.opts.Middleware,
+	}
+}
+
+/// report records the outcome of a request to node in its stats, requests we cancelled ourselves say nothing about the node
+func (cl *Client) report(node swarm.ServiceNode, started time.Time, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	var wrongSwarm *swarm.WrongSwarmError
+	if errors.As(err, &wrongSwarm) {
+		// the node answered properly, we just asked the wrong one
+		err = nil
+	}
+	cl.snodes.Report(node, time.Since(started), err)
+}
+
+/// via routes requests to node over our shared http client, through an onion path if onion requests are enabled, the returned func must be called with the request's error
+func (cl *Client) via(node swarm.ServiceNode) (swarm.ServiceNode, func(error), error) {
+	started := time.Now()
+	if !cl.opts.OnionRequests {
+		return node.Using(cl.directTransport()), func(err error) {
+			cl.report(node, started, err)
+		}, nil
+	}
+	path, err := cl.paths.pick(&cl.snodes, node)
+	if err != nil {
+		return node, nil, err
+	}
+	onion := &swarm.OnionTransport{
+		Path:            path.hops,
+		DirectTransport: *cl.directTransport(),
+	}
+	return node.Using(onion), func(err error) {
+		if errors.Is(err, rpc.ErrPathFailed) {
+			// we can't tell which hop failed, so blame the guard we talked to
+			cl.paths.drop(path)
+			cl.report(path.hops[0], started, err)
+			return
+		}
+		cl.report(node, started, err)
+	}, nil
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/majestrate/ubw/lib/model"
+	"github.com/majestrate/ubw/lib/swarm/swarmtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/// TestConcurrentSendReceiveUpdate is most useful under go test -race
+func TestConcurrentSendReceiveUpdate(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+	const senders = 4
+	const perSender = 5
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, senders*perSender*3)
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				_, err := alice.SendTo(ctx, bob.SessionID(), fmt.Sprintf("%d-%d", s, i))
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(s)
+	}
+	var mtx sync.Mutex
+	got := make(map[string]int)
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				msgs, err := bob.FetchNewMessages(ctx)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				mtx.Lock()
+				for _, msg := range msgs {
+					got[msg.Hash]++
+				}
+				mtx.Unlock()
+				err = bob.Update(ctx)
+				if err != nil {
+					errs <- err
+				}
+				bob.snodes.Stats()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < perSender; i++ {
+			bob.snodes.Replace(net.Nodes())
+			alice.Prune(time.Now())
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent use failed: %s", err.Error())
+	}
+
+	msgs, err := bob.FetchNewMessages(ctx)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	for _, msg := range msgs {
+		got[msg.Hash]++
+	}
+	if len(got) != senders*perSender {
+		t.Fatalf("expected %d messages, got %d", senders*perSender, len(got))
+	}
+	for hash, n := range got {
+		if n != 1 {
+			t.Fatalf("message %s returned %d times", hash, n)
+		}
+	}
+}
+
+func TestConcurrentMemoryStore(t *testing.T) {
+	store := MemoryStore()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				hash := fmt.Sprintf("%d-%d", w, i)
+				store.Put(model.Message{Hash: hash, Timestamp: fmt.Sprint(i), Owner: "05aa"})
+				store.HasMessage(hash)
+				store.LastHash("05aa")
+				store.PutOutgoing(OutgoingMessage{ID: hash, Owner: "05aa"})
+				store.Outgoing("05aa")
+				store.ClaimOutgoing("05aa", time.Now(), time.Minute, 1)
+				store.DeleteOutgoing("05aa", hash)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
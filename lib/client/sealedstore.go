@@ -0,0 +1,227 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"github.com/majestrate/ubw/lib/model"
+	"strings"
+	"time"
+)
+
+/// ErrWrongStorageKey is returned when a sealed database is opened with another key than the one it was sealed with
+var ErrWrongStorageKey = errors.New("database was sealed with a different storage key")
+
+/// sealedKeyCheck is tagged with the storage key to mark which key a database was sealed with
+const sealedKeyCheck = "ubw sealed database"
+
+/// sealedSearchPage is how many sealed history messages are opened at a time when searching, bodies can only be searched once opened
+const sealedSearchPage = 200
+
+/// sealedStore encrypts what it hands to another store so the database alone does not reveal our messages
+/// hashes, owners and timestamps are left as they are so the store can still index, scope and prune them
+type sealedStore struct {
+	MessageStore
+	key *[cryptography.StorageKeySize]byte
+}
+
+/// sealedHistoryStore is a sealedStore over a store that also keeps conversations
+type sealedHistoryStore struct {
+	sealedStore
+	history ConversationStore
+}
+
+/// sealedConversation is what is sealed into the body of a stored conversation message
+type sealedConversation struct {
+	Thread string `json:"thread"`
+	From   string `json:"from"`
+	Body   string `json:"body"`
+}
+
+/// SealedStore wraps store so message contents, senders, recipients and history are encrypted with key before they are stored
+/// use KeyPair.StorageKey or KeyPair.PassphraseKey for key, a store written with one key cannot be read with another
+/// rows a database already holds from before it was sealed are sealed now, ErrWrongStorageKey is returned if it was sealed with another key
+func SealedStore(store MessageStore, key *[cryptography.StorageKeySize]byte) (MessageStore, error) {
+	sealed := &sealedStore{MessageStore: store, key: key}
+	if sealer, ok := store.(rowSealer); ok {
+		err := sealer.SealRows(cryptography.SecretTag(key, sealedKeyCheck), sealed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if history, ok := store.(ConversationStore); ok {
+		return &sealedHistoryStore{sealedStore: *sealed, history: history}, nil
+	}
+	return sealed, nil
+}
+
+func (s *sealedStore) AdoptUnowned(owner string) error {
+	if adopter, ok := s.MessageStore.(unownedAdopter); ok {
+		return adopter.AdoptUnowned(owner)
+	}
+	return nil
+}
+
+func (s *sealedStore) seal(data []byte) ([]byte, error) {
+	return cryptography.SealSecret(s.key, data)
+}
+
+func (s *sealedStore) sealString(str string) (string, error) {
+	sealed, err := s.seal([]byte(str))
+	return base64.StdEncoding.EncodeToString(sealed), err
+}
+
+func (s *sealedStore) openString(str string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return "", cryptography.ErrDecryptError
+	}
+	data, err := cryptography.OpenSecret(s.key, sealed)
+	return string(data), err
+}
+
+func (s *sealedStore) sealMessage(msg *model.Message) (err error) {
+	msg.Raw, err = s.seal(msg.Raw)
+	if err == nil && msg.From != "" {
+		msg.From, err = s.sealString(msg.From)
+	}
+	return
+}
+
+func (s *sealedStore) sealOutgoing(msg *OutgoingMessage) (err error) {
+	msg.To, err = s.sealString(msg.To)
+	if err == nil {
+		msg.Raw, err = s.seal(msg.Raw)
+	}
+	return
+}
+
+/// sealConversation seals everything that identifies who a conversation is with, threads become tags so they can still be matched
+func (s *sealedStore) sealConversation(msg *ConversationMessage) error {
+	data, err := json.Marshal(sealedConversation{Thread: msg.Thread, From: msg.From, Body: msg.Body})
+	if err != nil {
+		return err
+	}
+	msg.Thread = cryptography.SecretTag(s.key, msg.Thread)
+	msg.From = ""
+	msg.Body, err = s.sealString(string(data))
+	return err
+}
+
+func (s *sealedStore) Put(msg model.Message) (bool, error) {
+	err := s.sealMessage(&msg)
+	if err != nil {
+		return false, err
+	}
+	return s.MessageStore.Put(msg)
+}
+
+func (s *sealedStore) PutOutgoing(msg OutgoingMessage) error {
+	err := s.sealOutgoing(&msg)
+	if err != nil {
+		return err
+	}
+	return s.MessageStore.PutOutgoing(msg)
+}
+
+func (s *sealedStore) Outgoing(owner string) ([]OutgoingMessage, error) {
+	return s.openOutgoing(s.MessageStore.Outgoing(owner))
+}
+
+func (s *sealedStore) ClaimOutgoing(owner string, now time.Time, lease time.Duration, n int) ([]OutgoingMessage, error) {
+	return s.openOutgoing(s.MessageStore.ClaimOutgoing(owner, now, lease, n))
+}
+
+func (s *sealedStore) openOutgoing(msgs []OutgoingMessage, err error) ([]OutgoingMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	for idx := range msgs {
+		msgs[idx].To, err = s.openString(msgs[idx].To)
+		if err != nil {
+			return nil, err
+		}
+		msgs[idx].Raw, err = cryptography.OpenSecret(s.key, msgs[idx].Raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (s *sealedHistoryStore) PutConversation(msg ConversationMessage) error {
+	err := s.sealConversation(&msg)
+	if err != nil {
+		return err
+	}
+	return s.history.PutConversation(msg)
+}
+
+func (s *sealedHistoryStore) open(msg ConversationMessage) (ConversationMessage, error) {
+	data, err := s.openString(msg.Body)
+	if err != nil {
+		return msg, err
+	}
+	var conv sealedConversation
+	err = json.Unmarshal([]byte(data), &conv)
+	msg.Thread = conv.Thread
+	msg.From = conv.From
+	msg.Body = conv.Body
+	return msg, err
+}
+
+/// History opens the messages matching q, searches are done here after opening as the store only sees ciphertext
+func (s *sealedHistoryStore) History(q HistoryQuery) ([]ConversationMessage, error) {
+	inner := HistoryQuery{Owner: q.Owner, Since: q.Since, Limit: q.Limit, Offset: q.Offset}
+	if q.Thread != "" {
+		inner.Thread = cryptography.SecretTag(s.key, q.Thread)
+	}
+	if q.Search == "" {
+		return s.openAll(inner)
+	}
+	search := strings.ToLower(q.Search)
+	skip := q.Offset
+	var found []ConversationMessage
+	inner.Limit = sealedSearchPage
+	for inner.Offset = 0; ; inner.Offset += sealedSearchPage {
+		page, err := s.openAll(inner)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range page {
+			if !strings.Contains(strings.ToLower(msg.Body), search) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			found = append(found, msg)
+			if len(found) == q.limit() {
+				return found, nil
+			}
+		}
+		if len(page) < sealedSearchPage {
+			return found, nil
+		}
+	}
+}
+
+func (s *sealedHistoryStore) openAll(q HistoryQuery) ([]ConversationMessage, error) {
+	msgs, err := s.history.History(q)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range msgs {
+		msgs[idx], err = s.open(msgs[idx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (s *sealedHistoryStore) PruneHistory(owner string, sentBefore time.Time) (int, error) {
+	return s.history.PruneHistory(owner, sentBefore)
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"github.com/majestrate/ubw/lib/model"
+	"testing"
+	"time"
+)
+
+func testStorageKey(b byte) *[cryptography.StorageKeySize]byte {
+	key := new([cryptography.StorageKeySize]byte)
+	for idx := range key {
+		key[idx] = b
+	}
+	return key
+}
+
+func TestSealedStoreHidesContents(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	inner, err := SQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	store, err := SealedStore(inner, testStorageKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Put(model.Message{Hash: "h1", Raw: []byte("secret raw"), Timestamp: "1000", Owner: "05aa", From: "05sender"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutOutgoing(OutgoingMessage{ID: "out1", Owner: "05me", To: "05recipient", Raw: []byte("secret outgoing"), Deadline: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.(ConversationStore).PutConversation(ConversationMessage{ID: "c1", Owner: "05me", Thread: "05sender", From: "05sender", Body: "secret body", SentAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw, from, to, outgoing, thread, body []byte
+	db.QueryRow("SELECT contents, sender FROM messages WHERE hash='h1'").Scan(&raw, &from)
+	db.QueryRow("SELECT recipient, contents FROM outbox WHERE id='out1'").Scan(&to, &outgoing)
+	db.QueryRow("SELECT thread, body FROM conversations WHERE id='c1'").Scan(&thread, &body)
+	for _, stored := range [][]byte{raw, from, to, outgoing, thread, body} {
+		if bytes.Contains(stored, []byte("secret")) || bytes.Contains(stored, []byte("05sender")) || bytes.Contains(stored, []byte("05recipient")) {
+			t.Fatalf("stored %q in the clear", stored)
+		}
+	}
+	if store.LastHash("05aa") != "h1" || !store.HasMessage("h1") {
+		t.Fatal("sealed message is not indexed by hash and owner")
+	}
+
+	msgs, err := store.Outgoing("05me")
+	if err != nil || len(msgs) != 1 || msgs[0].To != "05recipient" || string(msgs[0].Raw) != "secret outgoing" {
+		t.Fatalf("outgoing did not open: %v %v", msgs, err)
+	}
+	found, err := store.(ConversationStore).History(HistoryQuery{Owner: "05me", Thread: "05sender", Search: "BODY"})
+	if err != nil || len(found) != 1 || found[0].Body != "secret body" || found[0].From != "05sender" {
+		t.Fatalf("history did not open: %v %v", found, err)
+	}
+
+	// the same database cannot be opened with another key
+	_, err = SealedStore(inner, testStorageKey(2))
+	if err != ErrWrongStorageKey {
+		t.Fatalf("opening with the wrong key gave %v", err)
+	}
+}
+
+func TestSealExistingDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	inner, err := SQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	// rows written before encrypt_database was turned on
+	_, err = inner.Put(model.Message{Hash: "h1", Raw: []byte("secret raw"), Timestamp: "1000", Owner: "05aa", From: "05sender"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inner.PutOutgoing(OutgoingMessage{ID: "out1", Owner: "05me", To: "05recipient", Raw: []byte("secret outgoing"), Deadline: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inner.(ConversationStore).PutConversation(ConversationMessage{ID: "c1", Owner: "05me", Thread: "05sender", From: "05sender", Body: "secret body", SentAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opening it sealed twice must seal the rows once
+	var store MessageStore
+	for i := 0; i < 2; i++ {
+		store, err = SealedStore(inner, testStorageKey(1))
+		if err != nil {
+			t.Fatalf("sealing an existing database failed: %v", err)
+		}
+	}
+	var raw, from, to, outgoing, thread, body []byte
+	db.QueryRow("SELECT contents, sender FROM messages WHERE hash='h1'").Scan(&raw, &from)
+	db.QueryRow("SELECT recipient, contents FROM outbox WHERE id='out1'").Scan(&to, &outgoing)
+	db.QueryRow("SELECT thread, body FROM conversations WHERE id='c1'").Scan(&thread, &body)
+	for _, stored := range [][]byte{raw, from, to, outgoing, thread, body} {
+		if bytes.Contains(stored, []byte("secret")) || bytes.Contains(stored, []byte("05sender")) || bytes.Contains(stored, []byte("05recipient")) {
+			t.Fatalf("stored %q in the clear", stored)
+		}
+	}
+	claimed, err := store.ClaimOutgoing("05me", time.Now(), time.Minute, 10)
+	if err != nil || len(claimed) != 1 || claimed[0].To != "05recipient" || string(claimed[0].Raw) != "secret outgoing" {
+		t.Fatalf("outgoing did not open after sealing: %v %v", claimed, err)
+	}
+	found, err := store.(ConversationStore).History(HistoryQuery{Owner: "05me", Thread: "05sender"})
+	if err != nil || len(found) != 1 || found[0].Body != "secret body" || found[0].From != "05sender" {
+		t.Fatalf("history did not open after sealing: %v %v", found, err)
+	}
+}
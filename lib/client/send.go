@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/majestrate/ubw/lib/model"
+	"github.com/majestrate/ubw/lib/swarm"
+	"strings"
+	"sync"
+)
+
+const defaultStoreCopies = 3
+const defaultStoreQuorum = 1
+
+/// maxStoreRounds bounds how many times a send replaces members that failed or moved
+const maxStoreRounds = 3
+
+/// ErrQuorumNotReached is wrapped by send errors when too few swarm members accepted the message
+var ErrQuorumNotReached = errors.New("message store quorum not reached")
+
+/// SendResult says how a message was stored in the recipient's swarm
+type SendResult struct {
+	/// Accepted is how many swarm members stored the message
+	Accepted int
+	/// Attempted is how many swarm members we asked
+	Attempted int
+	/// Errors holds the error from every member that did not store the message
+	Errors []error
+}
+
+func (r *SendResult) quorumError(quorum int) error {
+	var reasons []string
+	for _, err := range r.Errors {
+		reasons = append(reasons, err.Error())
+	}
+	return fmt.Errorf("%w: %d of %d nodes accepted, %d needed: %s", ErrQuorumNotReached, r.Accepted, r.Attempted, quorum, strings.Join(reasons, "; "))
+}
+
+/// send stores an encrypted message in dst's swarm and checks the result against the quorum
+func (cl *Client) send(ctx context.Context, dst string, msg model.Message) (*SendResult, error) {
+	result := cl.storeToSwarm(ctx, dst, msg)
+	if quorum := cl.opts.storeQuorum(); result.Accepted < quorum {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if result.Attempted == 0 {
+			return result, fmt.Errorf("%w: %s", ErrQuorumNotReached, ErrNoSwarm.Error())
+		}
+		return result, result.quorumError(quorum)
+	}
+	return result, nil
+}
+
+/// storeToSwarm stores msg on StoreCopies members of the swarm for dst in parallel, members that fail or say the swarm moved are replaced by untried ones
+func (cl *Client) storeToSwarm(ctx context.Context, dst string, msg model.Message) *SendResult {
+	result := new(SendResult)
+	copies := cl.opts.storeCopies()
+	tried := make(map[string]bool)
+	for round := 0; round < maxStoreRounds && result.Accepted < copies; round++ {
+		var batch []swarm.ServiceNode
+		for _, member := range cl.snodes.Order(cl.swarms.get(&cl.snodes, dst)) {
+			if len(batch) == copies-result.Accepted {
+				break
+			}
+			if !tried[member.IdentityKey] {
+				tried[member.IdentityKey] = true
+				batch = append(batch, member)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for idx := range batch {
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				errs[idx] = cl.storeOn(ctx, batch[idx], dst, msg)
+			}(idx)
+		}
+		wg.Wait()
+		result.Attempted += len(batch)
+		for _, err := range errs {
+			if err == nil {
+				result.Accepted++
+				continue
+			}
+			result.Errors = append(result.Errors, err)
+			var wrongSwarm *swarm.WrongSwarmError
+			if errors.As(err, &wrongSwarm) && len(wrongSwarm.Swarm) > 0 {
+				cl.followRedirect(dst, wrongSwarm.Swarm)
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return result
+}
+
+func (cl *Client) storeOn(ctx context.Context, member swarm.ServiceNode, dst string, msg model.Message) error {
+	node, done, err := cl.via(member)
+	if err != nil {
+		return err
+	}
+	reqCtx, cancel := cl.requestContext(ctx)
+	defer cancel()
+	err = node.Store(reqCtx, dst, msg)
+	done(err)
+	return err
+}
@@ -1,18 +1,86 @@
 package client
 
 import (
+	"context"
 	"github.com/majestrate/ubw/lib/constants"
 	"github.com/majestrate/ubw/lib/swarm"
+	"math"
 	"math/rand"
+	"sort"
+	"sync"
 	"time"
 )
 
+/// SnodeMap is our view of the service node list and how each node has behaved, it is safe for concurrent use
 type SnodeMap struct {
+	mtx          sync.RWMutex
 	snodeMap     map[string]swarm.ServiceNode
+	stats        map[string]*NodeStats
 	nextUpdateAt time.Time
+	/// version changes every time the snode list is replaced
+	version uint64
+}
+
+/// NodeStats is how a service node has behaved when we talked to it
+type NodeStats struct {
+	Successes           uint64
+	Failures            uint64
+	ConsecutiveFailures int
+	/// Latency is a moving average of successful request times
+	Latency     time.Duration
+	LastError   string
+	LastErrorAt time.Time
+	/// ExcludedUntil is when a failing node may be picked again
+	ExcludedUntil time.Time
+}
+
+/// failuresBeforeExclusion is how many failures in a row exclude a node from selection
+const failuresBeforeExclusion = 3
+
+const minExclusion = 30 * time.Second
+const maxExclusion = 30 * time.Minute
+
+/// latencyWeight is how much the newest sample moves the latency average
+const latencyWeight = 0.25
+
+func (st *NodeStats) excluded(now time.Time) bool {
+	return now.Before(st.ExcludedUntil)
+}
+
+/// score weights a node for selection by its success rate and latency
+func (st *NodeStats) score() float64 {
+	rate := float64(st.Successes+1) / float64(st.Successes+st.Failures+2)
+	return rate / (1 + st.Latency.Seconds())
+}
+
+func (st *NodeStats) report(latency time.Duration, err error, now time.Time) {
+	if err == nil {
+		st.Successes++
+		st.ConsecutiveFailures = 0
+		st.ExcludedUntil = time.Time{}
+		if st.Latency == 0 {
+			st.Latency = latency
+		} else {
+			st.Latency += time.Duration(latencyWeight * float64(latency-st.Latency))
+		}
+		return
+	}
+	st.Failures++
+	st.ConsecutiveFailures++
+	st.LastError = err.Error()
+	st.LastErrorAt = now
+	if st.ConsecutiveFailures >= failuresBeforeExclusion {
+		backoff := minExclusion << uint(st.ConsecutiveFailures-failuresBeforeExclusion)
+		if backoff > maxExclusion || backoff <= 0 {
+			backoff = maxExclusion
+		}
+		st.ExcludedUntil = now.Add(backoff)
+	}
 }
 
 func (s *SnodeMap) All() (nodes []swarm.ServiceNode) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 	for _, node := range s.snodeMap {
 		nodes = append(nodes, node)
 	}
@@ -20,7 +88,7 @@ func (s *SnodeMap) All() (nodes []swarm.ServiceNode) {
 }
 
 func (s *SnodeMap) VisitSwarmFor(id string, max int, visit func(swarm.ServiceNode)) {
-	for _, snode := range swarm.GetSwarmForPubkey(s.All(), id[2:]) {
+	for _, snode := range s.SwarmFor(id) {
 		if max > 0 {
 			max--
 			visit(snode)
@@ -28,37 +96,199 @@ func (s *SnodeMap) VisitSwarmFor(id string, max int, visit func(swarm.ServiceNod
 	}
 }
 
-func (s *SnodeMap) Random() (node swarm.ServiceNode) {
-	if s.Empty() {
-		return
-	}
-	idx := rand.Int() % len(s.snodeMap)
-	for _, info := range s.snodeMap {
-		if idx == 0 {
-			node = info
+/// Healthy returns the nodes that are not excluded for failing, or every node if they all are
+func (s *SnodeMap) Healthy() []swarm.ServiceNode {
+	return s.healthy(s.All())
+}
+
+func (s *SnodeMap) healthy(nodes []swarm.ServiceNode) (healthy []swarm.ServiceNode) {
+	now := time.Now()
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, node := range nodes {
+		st, ok := s.stats[node.IdentityKey]
+		if !ok || !st.excluded(now) {
+			healthy = append(healthy, node)
 		}
-		idx--
+	}
+	if len(healthy) == 0 {
+		return nodes
 	}
 	return
 }
 
+func (s *SnodeMap) scoreOf(node swarm.ServiceNode) float64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	st, ok := s.stats[node.IdentityKey]
+	if !ok {
+		return new(NodeStats).score()
+	}
+	return st.score()
+}
+
+/// weightedShuffle orders nodes randomly with healthier nodes more likely to come first
+func (s *SnodeMap) weightedShuffle(nodes []swarm.ServiceNode) []swarm.ServiceNode {
+	keys := make([]float64, len(nodes))
+	for idx, node := range nodes {
+		// weighted random sampling without replacement: key = u^(1/w)
+		keys[idx] = math.Pow(rand.Float64(), 1/s.scoreOf(node))
+	}
+	sort.Sort(&byKey{nodes: nodes, keys: keys})
+	return nodes
+}
+
+type byKey struct {
+	nodes []swarm.ServiceNode
+	keys  []float64
+}
+
+func (b *byKey) Len() int           { return len(b.nodes) }
+func (b *byKey) Less(i, j int) bool { return b.keys[i] > b.keys[j] }
+func (b *byKey) Swap(i, j int) {
+	b.nodes[i], b.nodes[j] = b.nodes[j], b.nodes[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+/// Random picks a node that is not excluded, weighted toward healthy nodes
+func (s *SnodeMap) Random() (node swarm.ServiceNode) {
+	nodes := s.RandomN(1)
+	if len(nodes) > 0 {
+		node = nodes[0]
+	}
+	return
+}
+
+/// RandomN returns up to n distinct nodes that are not excluded, weighted toward healthy nodes
+func (s *SnodeMap) RandomN(n int) []swarm.ServiceNode {
+	nodes := s.weightedShuffle(s.Healthy())
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+/// Report records the outcome of a request to node
+func (s *SnodeMap) Report(node swarm.ServiceNode, latency time.Duration, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.stats == nil {
+		s.stats = make(map[string]*NodeStats)
+	}
+	st, ok := s.stats[node.IdentityKey]
+	if !ok {
+		st = new(NodeStats)
+		s.stats[node.IdentityKey] = st
+	}
+	st.report(latency, err, time.Now())
+}
+
+/// Stats returns a copy of the stats of every node we have talked to, keyed by identity key
+func (s *SnodeMap) Stats() map[string]NodeStats {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	stats := make(map[string]NodeStats, len(s.stats))
+	for key, st := range s.stats {
+		stats[key] = *st
+	}
+	return stats
+}
+
 func (s *SnodeMap) Empty() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 	return len(s.snodeMap) == 0
 }
 
+/// ShouldUpdate returns true once the snode list is due to be refreshed
 func (s *SnodeMap) ShouldUpdate() bool {
-	return s.nextUpdateAt.After(time.Now())
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return !time.Now().Before(s.nextUpdateAt)
 }
 
-func (s *SnodeMap) Update(node swarm.ServiceNode) error {
-	peers, err := node.GetSNodeList()
-	if err != nil {
-		return err
-	}
-	s.snodeMap = make(map[string]swarm.ServiceNode)
+/// NextUpdateAt returns when the snode list is next due to be refreshed
+func (s *SnodeMap) NextUpdateAt() time.Time {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.nextUpdateAt
+}
+
+/// Replace swaps the snode list for peers and schedules the next refresh
+func (s *SnodeMap) Replace(peers []swarm.ServiceNode) {
+	snodeMap := make(map[string]swarm.ServiceNode)
 	for _, peer := range peers {
-		s.snodeMap[peer.IdentityKey] = peer
+		snodeMap[peer.IdentityKey] = peer
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.snodeMap = snodeMap
+	for key := range s.stats {
+		if _, ok := snodeMap[key]; !ok {
+			delete(s.stats, key)
+		}
 	}
 	s.nextUpdateAt = time.Now().Add(constants.SNodeMapUpdateInterval * time.Second)
+	s.version++
+}
+
+/// Version returns a number that changes every time the snode list is replaced
+func (s *SnodeMap) Version() uint64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.version
+}
+
+/// SwarmFor returns the nodes in the swarm for the session id according to our snode list
+func (s *SnodeMap) SwarmFor(id string) []swarm.ServiceNode {
+	return swarm.GetSwarmForPubkey(s.All(), id[2:])
+}
+
+/// Known returns our own entries for the nodes in nodes we know by identity key, the rest are dropped
+func (s *SnodeMap) Known(nodes []swarm.ServiceNode) (known []swarm.ServiceNode) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, node := range nodes {
+		if ours, ok := s.snodeMap[node.IdentityKey]; ok {
+			known = append(known, ours)
+		}
+	}
+	return
+}
+
+/// Order returns a copy of nodes with excluded nodes removed and healthier nodes more likely to come first
+func (s *SnodeMap) Order(nodes []swarm.ServiceNode) []swarm.ServiceNode {
+	return s.weightedShuffle(append([]swarm.ServiceNode(nil), s.healthy(nodes)...))
+}
+
+/// Update replaces the snode list with the list fetched from node
+func (s *SnodeMap) Update(ctx context.Context, node swarm.ServiceNode) error {
+	peers, err := node.GetSNodeList(ctx)
+	if err != nil {
+		return err
+	}
+	s.Replace(peers)
 	return nil
 }
+
+/// mergeSNodeLists combines the lists fetched from several nodes, keeping nodes that at least half of them know about so a single bad source cannot add or drop nodes
+func mergeSNodeLists(lists [][]swarm.ServiceNode) (merged []swarm.ServiceNode) {
+	seen := make(map[string]int)
+	latest := make(map[string]swarm.ServiceNode)
+	var order []string
+	for _, list := range lists {
+		for _, node := range list {
+			if _, ok := seen[node.IdentityKey]; !ok {
+				order = append(order, node.IdentityKey)
+			}
+			seen[node.IdentityKey]++
+			latest[node.IdentityKey] = node
+		}
+	}
+	for _, key := range order {
+		if seen[key]*2 >= len(lists) {
+			merged = append(merged, latest[key])
+		}
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"errors"
+	"github.com/majestrate/ubw/lib/swarm"
+	"testing"
+	"time"
+)
+
+func TestMergeSNodeLists(t *testing.T) {
+	a := swarm.ServiceNode{IdentityKey: "a"}
+	b := swarm.ServiceNode{IdentityKey: "b"}
+	c := swarm.ServiceNode{IdentityKey: "c"}
+	bogus := swarm.ServiceNode{IdentityKey: "bogus"}
+	merged := mergeSNodeLists([][]swarm.ServiceNode{
+		{a, b, c},
+		{a, b},
+		{a, b, c, bogus},
+	})
+	if len(merged) != 3 {
+		t.Fatalf("expected 3 nodes, got %+v", merged)
+	}
+	for _, node := range merged {
+		if node.IdentityKey == "bogus" {
+			t.Fatal("node known by only one source was kept")
+		}
+	}
+}
+
+func TestFailingNodesAreExcluded(t *testing.T) {
+	var snodes SnodeMap
+	good := swarm.ServiceNode{IdentityKey: "good"}
+	bad := swarm.ServiceNode{IdentityKey: "bad"}
+	snodes.Replace([]swarm.ServiceNode{good, bad})
+	for try := 0; try < failuresBeforeExclusion; try++ {
+		snodes.Report(bad, time.Second, errors.New("timed out"))
+	}
+	snodes.Report(good, 10*time.Millisecond, nil)
+	for try := 0; try < 20; try++ {
+		if node := snodes.Random(); node.IdentityKey != "good" {
+			t.Fatalf("picked excluded node %s", node.IdentityKey)
+		}
+	}
+	stats := snodes.Stats()
+	if stats["bad"].Failures != failuresBeforeExclusion || stats["bad"].LastError != "timed out" {
+		t.Fatalf("bad stats: %+v", stats["bad"])
+	}
+	if stats["good"].Successes != 1 || stats["good"].Latency != 10*time.Millisecond {
+		t.Fatalf("good stats: %+v", stats["good"])
+	}
+	snodes.Report(bad, time.Second, nil)
+	if snodes.Stats()["bad"].ConsecutiveFailures != 0 {
+		t.Fatal("success did not reset consecutive failures")
+	}
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"database/sql"
+	"github.com/majestrate/ubw/lib/model"
+)
+
+/// sealedSetting names the store setting holding the tag of the key a database was sealed with
+const sealedSetting = "sealed_with"
+
+/// SealRows seals the messages, outbox and history of a database opened sealed for the first time
+/// it runs in one transaction under the migration lock, so a failure leaves the database as it was and instances starting together seal it once
+func (s *sqlStore) SealRows(keyTag string, sealing rowSealing) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.dialect.lockMigrations != "" {
+		_, err = tx.Exec(s.dialect.lockMigrations)
+		if err != nil {
+			return err
+		}
+	}
+	var sealedWith string
+	err = tx.QueryRow(s.dialect.rebind("SELECT value FROM store_settings WHERE name=?"), sealedSetting).Scan(&sealedWith)
+	if err == nil {
+		if sealedWith != keyTag {
+			return ErrWrongStorageKey
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	for _, seal := range []func(*sql.Tx, rowSealing) error{s.sealMessages, s.sealOutbox, s.sealConversations} {
+		err = seal(tx, sealing)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(s.dialect.rebind("INSERT INTO store_settings(name, value) VALUES(?,?)"), sealedSetting, keyTag)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/// readMessageRows reads what sealing changes in every message, the rows are closed before they are updated as sqlite connections cannot do both
+func readMessageRows(tx *sql.Tx) ([]model.Message, error) {
+	rows, err := tx.Query("SELECT hash, contents, sender FROM messages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []model.Message
+	for rows.Next() {
+		var msg model.Message
+		err = rows.Scan(&msg.Hash, &msg.Raw, &msg.From)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqlStore) sealMessages(tx *sql.Tx, sealing rowSealing) error {
+	msgs, err := readMessageRows(tx)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		pruned := len(msg.Raw) == 0
+		err = sealing.sealMessage(&msg)
+		if err != nil {
+			return err
+		}
+		if pruned {
+			// contents dropped by PruneExpired stay empty so they are not pruned again
+			msg.Raw = []byte{}
+		}
+		_, err = tx.Exec(s.dialect.rebind("UPDATE messages SET contents=?, sender=? WHERE hash=?"), msg.Raw, msg.From, msg.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readOutboxRows(tx *sql.Tx) ([]OutgoingMessage, error) {
+	rows, err := tx.Query("SELECT id, recipient, contents FROM outbox")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []OutgoingMessage
+	for rows.Next() {
+		var msg OutgoingMessage
+		err = rows.Scan(&msg.ID, &msg.To, &msg.Raw)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqlStore) sealOutbox(tx *sql.Tx, sealing rowSealing) error {
+	msgs, err := readOutboxRows(tx)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		err = sealing.sealOutgoing(&msg)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(s.dialect.rebind("UPDATE outbox SET recipient=?, contents=? WHERE id=?"), msg.To, msg.Raw, msg.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readConversationRows(tx *sql.Tx) ([]ConversationMessage, error) {
+	rows, err := tx.Query("SELECT id, thread, sender, body FROM conversations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []ConversationMessage
+	for rows.Next() {
+		var msg ConversationMessage
+		err = rows.Scan(&msg.ID, &msg.Thread, &msg.From, &msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqlStore) sealConversations(tx *sql.Tx, sealing rowSealing) error {
+	msgs, err := readConversationRows(tx)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		err = sealing.sealConversation(&msg)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(s.dialect.rebind("UPDATE conversations SET thread=?, sender=?, body=? WHERE id=?"), msg.Thread, msg.From, msg.Body, msg.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
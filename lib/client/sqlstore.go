@@ -3,14 +3,31 @@ package client
 import (
 	"database/sql"
 	"github.com/majestrate/ubw/lib/model"
+	"strconv"
+	"strings"
+	"time"
 )
 
+/// sqlStore keeps messages in a database, it is safe for concurrent use as database/sql is
 type sqlStore struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect *dialect
+}
+
+func (s *sqlStore) execSQL(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.dialect.rebind(query), args...)
 }
 
 func (s *sqlStore) HasMessage(hash string) bool {
-	row := s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE hash=?", hash)
+	row := s.queryRow("SELECT COUNT(*) FROM messages WHERE hash=?", hash)
 	if row == nil {
 		return false
 	}
@@ -19,13 +36,43 @@ func (s *sqlStore) HasMessage(hash string) bool {
 	return count != 0
 }
 
-func (s *sqlStore) Put(msg model.Message) error {
-	_, err := s.db.Exec("INSERT INTO messages(hash, contents) VALUES(?,?)", msg.Hash, msg.Raw)
-	return err
+/// millis parses a millisecond timestamp from the storage server, anything unparsable is 0
+func millis(val string) int64 {
+	ms, _ := strconv.ParseInt(val, 10, 64)
+	return ms
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (s *sqlStore) Put(msg model.Message) (bool, error) {
+	n, err := s.changed("INSERT INTO messages(hash, contents, owner, server_timestamp, expiration, sender, sent_at) VALUES(?,?,?,?,?,?,?) ON CONFLICT(hash) DO NOTHING",
+		msg.Hash, msg.Raw, msg.Owner, millis(msg.Timestamp), millis(msg.Expiration), msg.From, msg.SentAt)
+	return n > 0, err
+}
+
+func (s *sqlStore) PruneExpired(expiredBefore, forgetBefore time.Time) (int, error) {
+	forgotten, err := s.changed("DELETE FROM messages WHERE expiration>0 AND expiration<?", toMillis(forgetBefore))
+	if err != nil {
+		return 0, err
+	}
+	dropped, err := s.changed("UPDATE messages SET contents='' WHERE expiration>0 AND expiration<? AND LENGTH(contents)>0", toMillis(expiredBefore))
+	return forgotten + dropped, err
 }
 
-func (s *sqlStore) LastHash() string {
-	row := s.db.QueryRow("SELECT hash FROM messages ORDER BY timestamp DESC LIMIT 1")
+/// changed runs a statement and returns how many rows it changed
+func (s *sqlStore) changed(query string, args ...interface{}) (int, error) {
+	result, err := s.execSQL(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqlStore) LastHash(pubkey string) string {
+	row := s.queryRow("SELECT hash FROM messages WHERE owner=? ORDER BY server_timestamp DESC LIMIT 1", pubkey)
 	if row == nil {
 		return ""
 	}
@@ -34,20 +81,152 @@ func (s *sqlStore) LastHash() string {
 	return h
 }
 
+func (s *sqlStore) PutOutgoing(msg OutgoingMessage) error {
+	_, err := s.execSQL(`INSERT INTO outbox(id, owner, recipient, contents, attempts, last_error, next_attempt, deadline) VALUES(?,?,?,?,?,?,?,?)
+ON CONFLICT(id) DO UPDATE SET attempts=excluded.attempts, last_error=excluded.last_error, next_attempt=excluded.next_attempt, deadline=excluded.deadline, claim='', claimed_until=0
+WHERE outbox.owner=excluded.owner`,
+		msg.ID, msg.Owner, msg.To, msg.Raw, msg.Attempts, msg.LastError, msg.NextAttempt.UnixNano(), msg.Deadline.UnixNano())
+	return err
+}
+
+const outgoingColumns = "id, owner, recipient, contents, attempts, last_error, next_attempt, deadline, claimed_until"
+
+func (s *sqlStore) Outgoing(owner string) ([]OutgoingMessage, error) {
+	return s.outgoing("SELECT "+outgoingColumns+" FROM outbox WHERE owner=?", owner)
+}
+
+/// ClaimOutgoing marks the claimed rows with a random claim in one statement, so concurrent claims never get the same row
+func (s *sqlStore) ClaimOutgoing(owner string, now time.Time, lease time.Duration, n int) ([]OutgoingMessage, error) {
+	claim, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	// claimed_until is checked again outside the subquery as postgres rechecks it against rows another claim changed while we waited for them
+	_, err = s.execSQL(`UPDATE outbox SET claim=?, claimed_until=?
+WHERE claimed_until<=? AND id IN (SELECT id FROM outbox WHERE owner=? AND next_attempt<=? AND claimed_until<=? ORDER BY next_attempt LIMIT ?)`,
+		claim, now.Add(lease).UnixNano(), now.UnixNano(), owner, now.UnixNano(), now.UnixNano(), n)
+	if err != nil {
+		return nil, err
+	}
+	return s.outgoing("SELECT "+outgoingColumns+" FROM outbox WHERE owner=? AND claim=?", owner, claim)
+}
+
+func (s *sqlStore) outgoing(query string, args ...interface{}) ([]OutgoingMessage, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []OutgoingMessage
+	for rows.Next() {
+		var msg OutgoingMessage
+		var nextAttempt, deadline, claimedUntil int64
+		err = rows.Scan(&msg.ID, &msg.Owner, &msg.To, &msg.Raw, &msg.Attempts, &msg.LastError, &nextAttempt, &deadline, &claimedUntil)
+		if err != nil {
+			return nil, err
+		}
+		msg.NextAttempt = time.Unix(0, nextAttempt)
+		msg.Deadline = time.Unix(0, deadline)
+		if claimedUntil > 0 {
+			msg.ClaimedUntil = time.Unix(0, claimedUntil)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqlStore) DeleteOutgoing(owner, id string) error {
+	_, err := s.execSQL("DELETE FROM outbox WHERE owner=? AND id=?", owner, id)
+	return err
+}
+
+/// AdoptUnowned gives outbox and history rows from before schema version 4 to owner, the first client to open an upgraded database gets them
+func (s *sqlStore) AdoptUnowned(owner string) error {
+	for _, table := range []string{"outbox", "conversations"} {
+		_, err := s.execSQL("UPDATE "+table+" SET owner=? WHERE owner=''", owner)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) PutConversation(msg ConversationMessage) error {
+	_, err := s.execSQL("INSERT INTO conversations(id, owner, thread, sender, direction, body, sent_at, stored_at) VALUES(?,?,?,?,?,?,?,?) ON CONFLICT(id) DO NOTHING",
+		msg.ID, msg.Owner, msg.Thread, msg.From, int(msg.Direction), msg.Body, toMillis(msg.SentAt), toMillis(msg.StoredAt))
+	return err
+}
+
+/// likeEscaper escapes the LIKE wildcards in a search string
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *sqlStore) History(q HistoryQuery) ([]ConversationMessage, error) {
+	where := []string{"owner=?"}
+	args := []interface{}{q.Owner}
+	if q.Thread != "" {
+		where = append(where, "thread=?")
+		args = append(args, q.Thread)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "sent_at>=?")
+		args = append(args, toMillis(q.Since))
+	}
+	if q.Search != "" {
+		where = append(where, `LOWER(body) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(q.Search))+"%")
+	}
+	query := "SELECT id, owner, thread, sender, direction, body, sent_at, stored_at FROM conversations WHERE " + strings.Join(where, " AND ")
+	query += " ORDER BY sent_at DESC LIMIT ? OFFSET ?"
+	args = append(args, q.limit(), q.Offset)
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []ConversationMessage
+	for rows.Next() {
+		var msg ConversationMessage
+		var direction int
+		var sentAt, storedAt int64
+		err = rows.Scan(&msg.ID, &msg.Owner, &msg.Thread, &msg.From, &direction, &msg.Body, &sentAt, &storedAt)
+		if err != nil {
+			return nil, err
+		}
+		msg.Direction = Direction(direction)
+		msg.SentAt = time.Unix(0, sentAt*int64(time.Millisecond))
+		msg.StoredAt = time.Unix(0, storedAt*int64(time.Millisecond))
+		found = append(found, msg)
+	}
+	return found, rows.Err()
+}
+
+func (s *sqlStore) PruneHistory(owner string, sentBefore time.Time) (int, error) {
+	return s.changed("DELETE FROM conversations WHERE owner=? AND sent_at<?", owner, toMillis(sentBefore))
+}
+
 func (s *sqlStore) Close() error {
 	return s.db.Close()
 }
 
 func (s *sqlStore) migrate() error {
-	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS messages(hash BLOB PRIMARY KEY, contents BLOB NOT NULL, timestamp DATETIME DEFAULT NOW )")
-	return err
+	return migrate(s.db, s.dialect, sqlMigrations)
+}
+
+/// SQLStore keeps messages in a sqlite database, migrating its schema first
+func SQLStore(c *sql.DB) (MessageStore, error) {
+	return newSQLStore(c, sqliteDialect)
+}
+
+/// PostgresStore keeps messages in a PostgreSQL database, migrating its schema first, several clients may share one database
+func PostgresStore(c *sql.DB) (MessageStore, error) {
+	return newSQLStore(c, postgresDialect)
 }
 
-func SQLStore(c *sql.DB) MessageStore {
-	s := &sqlStore{db: c}
+func newSQLStore(c *sql.DB, d *dialect) (MessageStore, error) {
+	s := &sqlStore{db: c, dialect: d}
 	err := s.migrate()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return s
+	return s, nil
 }
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"database/sql"
+	"github.com/majestrate/ubw/lib/model"
+	_ "github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the schema used before migrations were versioned
+	_, err = db.Exec("CREATE TABLE messages(hash BLOB PRIMARY KEY, contents BLOB NOT NULL, timestamp DATETIME DEFAULT NOW )")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO messages(hash, contents) VALUES(?,?)", "old", []byte("old contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := SQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := schemaVersion(db)
+	if err != nil || version != sqlMigrations[len(sqlMigrations)-1].version {
+		t.Fatalf("schema not upgraded, at version %d: %v", version, err)
+	}
+	if !store.HasMessage("old") {
+		t.Fatal("existing message lost in upgrade")
+	}
+	for _, msg := range []model.Message{
+		{Hash: "newer", Raw: []byte("b"), Timestamp: "2000", Expiration: "9000", Owner: "05aa", From: "05bb", SentAt: 1999},
+		{Hash: "new", Raw: []byte("a"), Timestamp: "1000", Expiration: "8000", Owner: "05aa"},
+	} {
+		_, err = store.Put(msg)
+		if err != nil {
+			t.Fatalf("put failed: %s", err.Error())
+		}
+	}
+	if hash := store.LastHash("05aa"); hash != "newer" {
+		t.Fatalf("last hash is %q, expected the message with the newest server timestamp", hash)
+	}
+	var sender string
+	var expiration int64
+	err = db.QueryRow("SELECT sender, expiration FROM messages WHERE hash=?", "newer").Scan(&sender, &expiration)
+	if err != nil || sender != "05bb" || expiration != 9000 {
+		t.Fatalf("metadata not stored: %q %d %v", sender, expiration, err)
+	}
+	store.Close()
+
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = SQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if !store.HasMessage("newer") {
+		t.Fatal("message lost on reopen")
+	}
+}
+
+func TestSQLStoreMigrationError(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	store, err := SQLStore(db)
+	if err == nil || store != nil {
+		t.Fatalf("opened a store on a closed database: %v", store)
+	}
+}
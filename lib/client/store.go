@@ -3,11 +3,64 @@ package client
 import (
 	"github.com/majestrate/ubw/lib/model"
 	"io"
+	"time"
 )
 
+/// MessageStore keeps the messages we fetched and our outbox, implementations must be safe for concurrent use
+/// several clients may share one store, outbox and history methods only touch the rows of the owner session id they are given
 type MessageStore interface {
 	HasMessage(hash string) bool
-	Put(msg model.Message) error
-	LastHash() string
+	/// Put stores msg unless a message with its hash is stored already, it returns true only if this call stored it
+	Put(msg model.Message) (bool, error)
+	/// LastHash returns the hash of the newest message stored for the mailbox of pubkey, or "" if there is none
+	LastHash(pubkey string) string
+	/// PutOutgoing adds msg to its owner's outbox or updates it if it is already there, releasing any claim on it
+	PutOutgoing(msg OutgoingMessage) error
+	/// Outgoing returns every message waiting in owner's outbox
+	Outgoing(owner string) ([]OutgoingMessage, error)
+	/// ClaimOutgoing claims up to n messages in owner's outbox that are due at now and not claimed already, they are not claimed again until lease has passed or they are put back
+	ClaimOutgoing(owner string, now time.Time, lease time.Duration, n int) ([]OutgoingMessage, error)
+	/// DeleteOutgoing removes a message from owner's outbox
+	DeleteOutgoing(owner, id string) error
+	/// PruneExpired drops the raw contents of messages that expired before expiredBefore but keeps their hashes so they are still known
+	/// messages that expired before forgetBefore are removed entirely, the network can no longer return them
+	PruneExpired(expiredBefore, forgetBefore time.Time) (int, error)
 	io.Closer
 }
+
+/// OutgoingMessage is an encrypted message waiting in the outbox to be stored in its recipient's swarm
+type OutgoingMessage struct {
+	ID string
+	/// Owner is the session id of the client sending the message
+	Owner     string
+	To        string
+	Raw       []byte
+	Attempts  int
+	LastError string
+	/// NextAttempt is when the message is next due to be sent
+	NextAttempt time.Time
+	/// Deadline is when we give up on the message
+	Deadline time.Time
+	/// ClaimedUntil is when a claim on the message by a sender runs out, it is zero if nobody is sending it
+	ClaimedUntil time.Time
+}
+
+/// rowSealer is implemented by stores whose databases may hold rows from before they were sealed
+type rowSealer interface {
+	/// SealRows seals every row with sealing the first time a database is opened sealed and marks it with keyTag
+	/// it returns ErrWrongStorageKey if the database was marked with another tag
+	SealRows(keyTag string, sealing rowSealing) error
+}
+
+/// rowSealing seals rows in place the way a sealed store writes them
+type rowSealing interface {
+	sealMessage(msg *model.Message) error
+	sealOutgoing(msg *OutgoingMessage) error
+	sealConversation(msg *ConversationMessage) error
+}
+
+/// unownedAdopter is implemented by stores whose databases may hold outbox and history rows from before they had owners
+type unownedAdopter interface {
+	/// AdoptUnowned gives every row without an owner to owner
+	AdoptUnowned(owner string) error
+}
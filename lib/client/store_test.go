@@ -0,0 +1,236 @@
+package client
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"github.com/majestrate/ubw/lib/model"
+	"os"
+	"testing"
+	"time"
+)
+
+/// eachStore runs fn against every MessageStore implementation
+func eachStore(t *testing.T, fn func(t *testing.T, store MessageStore)) {
+	t.Run("memory", func(t *testing.T) {
+		store := MemoryStore()
+		defer store.Close()
+		fn(t, store)
+	})
+	t.Run("sql", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		store, err := SQLStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		fn(t, store)
+	})
+	t.Run("sealed", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		inner, err := SQLStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := SealedStore(inner, testStorageKey(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		fn(t, store)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(postgresTestEnv)
+		if dsn == "" {
+			t.Skip("set " + postgresTestEnv + " to a dsn for a scratch database to test postgres")
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, table := range []string{"messages", "outbox", "conversations", "store_settings", "schema_version"} {
+			_, err = db.Exec("DROP TABLE IF EXISTS " + table)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		store, err := PostgresStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		fn(t, store)
+	})
+}
+
+/// postgresTestEnv names a postgres dsn to run the store tests against, every table in it is dropped
+const postgresTestEnv = "UBW_TEST_POSTGRES"
+
+func TestRebind(t *testing.T) {
+	query := "SELECT a FROM t WHERE b=? AND c LIKE ? LIMIT ?"
+	if got := sqliteDialect.rebind(query); got != query {
+		t.Fatalf("sqlite query rewritten to %q", got)
+	}
+	if got := postgresDialect.rebind(query); got != "SELECT a FROM t WHERE b=$1 AND c LIKE $2 LIMIT $3" {
+		t.Fatalf("postgres query rewritten to %q", got)
+	}
+}
+
+func TestLastHashPerMailbox(t *testing.T) {
+	eachStore(t, func(t *testing.T, store MessageStore) {
+		for _, msg := range []model.Message{
+			{Hash: "ours-old", Raw: []byte("a"), Timestamp: "1000", Owner: "05aa"},
+			{Hash: "theirs", Raw: []byte("b"), Timestamp: "3000", Owner: "05bb"},
+			{Hash: "ours-new", Raw: []byte("c"), Timestamp: "2000", Owner: "05aa"},
+		} {
+			_, err := store.Put(msg)
+			if err != nil {
+				t.Fatalf("put failed: %s", err.Error())
+			}
+		}
+		if hash := store.LastHash("05aa"); hash != "ours-new" {
+			t.Fatalf("last hash for 05aa is %q", hash)
+		}
+		if hash := store.LastHash("05bb"); hash != "theirs" {
+			t.Fatalf("last hash for 05bb is %q", hash)
+		}
+		if hash := store.LastHash("05cc"); hash != "" {
+			t.Fatalf("last hash for unknown mailbox is %q", hash)
+		}
+	})
+}
+
+func TestPutReportsInsert(t *testing.T) {
+	eachStore(t, func(t *testing.T, store MessageStore) {
+		msg := model.Message{Hash: "h1", Raw: []byte("a"), Timestamp: "1000", Owner: "05aa"}
+		inserted, err := store.Put(msg)
+		if err != nil || !inserted {
+			t.Fatalf("first put inserted=%v %v", inserted, err)
+		}
+		inserted, err = store.Put(msg)
+		if err != nil || inserted {
+			t.Fatalf("second put inserted=%v %v", inserted, err)
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	eachStore(t, func(t *testing.T, store MessageStore) {
+		history := store.(ConversationStore)
+		base := time.Unix(1600000000, 0)
+		for idx, body := range []string{"hello", "100% sure", "Hello again", "bye"} {
+			thread := "05aa"
+			if idx == 3 {
+				thread = "05bb"
+			}
+			err := history.PutConversation(ConversationMessage{
+				ID:       fmt.Sprintf("msg%d", idx),
+				Owner:    "05me",
+				Thread:   thread,
+				From:     thread,
+				Body:     body,
+				SentAt:   base.Add(time.Duration(idx) * time.Minute),
+				StoredAt: base,
+			})
+			if err != nil {
+				t.Fatalf("put failed: %s", err.Error())
+			}
+		}
+		// recording a message twice keeps one copy
+		history.PutConversation(ConversationMessage{ID: "msg0", Owner: "05me", Thread: "05aa", Body: "dup", SentAt: base})
+		// another client sharing the store
+		history.PutConversation(ConversationMessage{ID: "theirs", Owner: "05them", Thread: "05aa", Body: "hello", SentAt: base})
+
+		for _, tc := range []struct {
+			q   HistoryQuery
+			ids []string
+		}{
+			{HistoryQuery{}, []string{"msg3", "msg2", "msg1", "msg0"}},
+			{HistoryQuery{Thread: "05aa", Limit: 2}, []string{"msg2", "msg1"}},
+			{HistoryQuery{Thread: "05aa", Limit: 2, Offset: 2}, []string{"msg0"}},
+			{HistoryQuery{Since: base.Add(2 * time.Minute)}, []string{"msg3", "msg2"}},
+			{HistoryQuery{Search: "HELLO"}, []string{"msg2", "msg0"}},
+			{HistoryQuery{Search: "0%"}, []string{"msg1"}},
+			{HistoryQuery{Search: "_"}, nil},
+		} {
+			tc.q.Owner = "05me"
+			found, err := history.History(tc.q)
+			if err != nil {
+				t.Fatalf("query %+v failed: %s", tc.q, err.Error())
+			}
+			var ids []string
+			for _, msg := range found {
+				ids = append(ids, msg.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tc.ids) {
+				t.Fatalf("query %+v returned %v, expected %v", tc.q, ids, tc.ids)
+			}
+		}
+	})
+}
+
+func TestPruneExpired(t *testing.T) {
+	eachStore(t, func(t *testing.T, store MessageStore) {
+		base := time.Unix(1600000000, 0)
+		at := func(d time.Duration) string {
+			return fmt.Sprint(toMillis(base.Add(d)))
+		}
+		for _, msg := range []model.Message{
+			{Hash: "forgotten", Raw: []byte("a"), Timestamp: at(0), Expiration: at(time.Hour), Owner: "05aa"},
+			{Hash: "expired", Raw: []byte("b"), Timestamp: at(0), Expiration: at(3 * time.Hour), Owner: "05aa"},
+			{Hash: "live", Raw: []byte("c"), Timestamp: at(0), Expiration: at(5 * time.Hour), Owner: "05aa"},
+		} {
+			_, err := store.Put(msg)
+			if err != nil {
+				t.Fatalf("put failed: %s", err.Error())
+			}
+		}
+		pruned, err := store.PruneExpired(base.Add(4*time.Hour), base.Add(2*time.Hour))
+		if err != nil || pruned != 2 {
+			t.Fatalf("expected 2 pruned, got %d %v", pruned, err)
+		}
+		if store.HasMessage("forgotten") {
+			t.Fatal("message past the tombstone grace is still known")
+		}
+		if !store.HasMessage("expired") || !store.HasMessage("live") {
+			t.Fatal("pruning forgot a message that can still be fetched")
+		}
+		pruned, err = store.PruneExpired(base.Add(4*time.Hour), base.Add(2*time.Hour))
+		if err != nil || pruned != 0 {
+			t.Fatalf("expected nothing left to prune, got %d %v", pruned, err)
+		}
+	})
+}
+
+func TestPruneKeepsHistory(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		retention time.Duration
+		kept      int
+	}{
+		{0, 2},
+		{time.Hour, 1},
+	} {
+		cl := NewClient(cryptography.Keygen(), nil, &ClientOptions{HistoryRetention: tc.retention})
+		history := cl.store.(ConversationStore)
+		history.PutConversation(ConversationMessage{ID: "old", Owner: cl.SessionID(), Thread: "05aa", SentAt: now.Add(-2 * time.Hour)})
+		history.PutConversation(ConversationMessage{ID: "new", Owner: cl.SessionID(), Thread: "05aa", SentAt: now})
+		_, err := cl.Prune(now)
+		if err != nil {
+			t.Fatalf("prune failed: %s", err.Error())
+		}
+		found, _ := cl.History(HistoryQuery{})
+		if len(found) != tc.kept {
+			t.Fatalf("retention %s kept %d messages, expected %d", tc.retention, len(found), tc.kept)
+		}
+	}
+}
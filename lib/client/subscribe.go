@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"github.com/majestrate/ubw/lib/model"
+	"github.com/majestrate/ubw/lib/swarm"
+	"time"
+)
+
+const defaultPollInterval = 5 * time.Second
+const defaultMaxPollDelay = time.Minute
+
+/// eventBuffer is how many events are held for a slow reader before new ones are dropped
+const eventBuffer = 16
+
+/// EventKind says what an Event is about
+type EventKind int
+
+const (
+	/// EventError is a failed snode list update, poll or decrypt, Err says which
+	EventError EventKind = iota
+	/// EventSwarmChanged means our messages are now held by a different swarm, Swarm holds its members
+	EventSwarmChanged
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventError:
+		return "error"
+	case EventSwarmChanged:
+		return "swarm changed"
+	}
+	return "unknown"
+}
+
+/// Event is something a subscriber may want to know about that is not a message
+type Event struct {
+	Kind  EventKind
+	Err   error
+	Swarm []swarm.ServiceNode
+}
+
+/// Subscription delivers our new messages as they arrive, both channels are closed once its context is done
+type Subscription struct {
+	/// Messages receives every new message that decrypted whatever its content kind, in the order they were fetched
+	/// each message is delivered once even with several subscriptions or clients sharing a store, messages left over when ctx ends are delivered by the next subscription of this client
+	Messages <-chan *model.PlainMessage
+	/// Events receives errors and swarm changes, events are dropped if nobody is reading
+	Events <-chan Event
+}
+
+/// Subscribe polls our swarm for new messages until ctx is done, keeping the snode list fresh and backing off while polls fail
+func (cl *Client) Subscribe(ctx context.Context) *Subscription {
+	msgs := make(chan *model.PlainMessage)
+	events := make(chan Event, eventBuffer)
+	go cl.run(ctx, msgs, events)
+	return &Subscription{Messages: msgs, Events: events}
+}
+
+/// Run calls handler with every new message until ctx is done, onEvent may be nil
+func (cl *Client) Run(ctx context.Context, handler func(*model.PlainMessage), onEvent func(Event)) {
+	sub := cl.Subscribe(ctx)
+	go func() {
+		for ev := range sub.Events {
+			if onEvent != nil {
+				onEvent(ev)
+			}
+		}
+	}()
+	for msg := range sub.Messages {
+		handler(msg)
+	}
+}
+
+func sameNodes(a, b []swarm.ServiceNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := make(map[string]bool)
+	for _, node := range a {
+		keys[node.IdentityKey] = true
+	}
+	for _, node := range b {
+		if !keys[node.IdentityKey] {
+			return false
+		}
+	}
+	return true
+}
+
+/// deliverAll hands batch to a subscriber in order, if ctx ends first the rest is held for the next subscription and false is returned
+func (cl *Client) deliverAll(ctx context.Context, msgs chan<- *model.PlainMessage, batch []*model.PlainMessage) bool {
+	for i, msg := range batch {
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+			cl.recvMtx.Lock()
+			cl.undelivered = append(cl.undelivered, batch[i:]...)
+			cl.recvMtx.Unlock()
+			return false
+		}
+	}
+	return true
+}
+
+/// takeUndelivered returns and forgets the messages earlier subscriptions could not deliver
+func (cl *Client) takeUndelivered() []*model.PlainMessage {
+	cl.recvMtx.Lock()
+	defer cl.recvMtx.Unlock()
+	batch := cl.undelivered
+	cl.undelivered = nil
+	return batch
+}
+
+func (cl *Client) run(ctx context.Context, msgs chan<- *model.PlainMessage, events chan<- Event) {
+	defer close(msgs)
+	defer close(events)
+	emit := func(ev Event) {
+		select {
+		case events <- ev:
+		default:
+		}
+	}
+	interval := cl.opts.pollInterval()
+	delay := interval
+	var ourSwarm []swarm.ServiceNode
+	for {
+		if !cl.deliverAll(ctx, msgs, cl.takeUndelivered()) {
+			return
+		}
+		err := cl.Update(ctx)
+		if err == nil {
+			var fetched []received
+			fetched, err = cl.fetchFrom(ctx, cl.SessionID())
+			for _, r := range fetched {
+				if ctx.Err() != nil {
+					// the rest of the batch is not stored yet, so the next subscription fetches it again
+					return
+				}
+				var kept bool
+				kept, err = cl.keep(r)
+				if err != nil {
+					break
+				}
+				if !kept {
+					// another poll got it first and delivers it
+					continue
+				}
+				if r.err != nil {
+					emit(Event{Kind: EventError, Err: r.err})
+				} else if !cl.deliverAll(ctx, msgs, []*model.PlainMessage{r.plain}) {
+					return
+				}
+			}
+		}
+		if err == nil {
+			delay = interval
+			members := cl.swarms.get(&cl.snodes, cl.SessionID())
+			if ourSwarm != nil && !sameNodes(ourSwarm, members) {
+				emit(Event{Kind: EventSwarmChanged, Swarm: members})
+			}
+			ourSwarm = members
+		} else if ctx.Err() == nil {
+			emit(Event{Kind: EventError, Err: err})
+			delay *= 2
+			if max := cl.opts.maxPollDelay(); delay > max {
+				delay = max
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"github.com/majestrate/ubw/lib/swarm/swarmtest"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+	bob.opts.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := bob.Subscribe(ctx)
+
+	for _, body := range []string{"one", "two"} {
+		_, err := alice.SendTo(context.Background(), bob.SessionID(), body)
+		if err != nil {
+			t.Fatalf("send failed: %s", err.Error())
+		}
+	}
+	got := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(got) < 2 {
+		select {
+		case msg := <-sub.Messages:
+			if msg.From != alice.SessionID() {
+				t.Fatalf("message from %s", msg.From)
+			}
+			got[*msg.Body()] = true
+		case ev := <-sub.Events:
+			t.Fatalf("unexpected %s event: %v", ev.Kind, ev.Err)
+		case <-timeout:
+			t.Fatalf("timed out, got %v", got)
+		}
+	}
+	if !got["one"] || !got["two"] {
+		t.Fatalf("wrong messages: %v", got)
+	}
+
+	cancel()
+	for range sub.Messages {
+		t.Fatal("message after cancel")
+	}
+}
+
+func TestSubscribeRedeliversAfterCancel(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+	bob.opts.PollInterval = 10 * time.Millisecond
+	bodies := []string{"one", "two", "three"}
+	for _, body := range bodies {
+		_, err := alice.SendTo(context.Background(), bob.SessionID(), body)
+		if err != nil {
+			t.Fatalf("send failed: %s", err.Error())
+		}
+	}
+
+	// read one message of the batch then go away
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := bob.Subscribe(ctx)
+	got := 0
+	select {
+	case <-sub.Messages:
+		got++
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first message")
+	}
+	cancel()
+	for range sub.Messages {
+		got++
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	sub = bob.Subscribe(ctx)
+	timeout := time.After(5 * time.Second)
+	for got < len(bodies) {
+		select {
+		case <-sub.Messages:
+			got++
+		case <-timeout:
+			t.Fatalf("only %d of %d messages delivered", got, len(bodies))
+		}
+	}
+	cancel()
+	for range sub.Messages {
+		t.Fatal("message delivered twice")
+	}
+}
+
+func TestConcurrentSubscriptionsDeliverOnce(t *testing.T) {
+	net := swarmtest.NewNetwork(3, 3)
+	defer net.Close()
+
+	alice := newTestClient(t, net)
+	bob := newTestClient(t, net)
+	bob.opts.PollInterval = 10 * time.Millisecond
+	bodies := []string{"one", "two", "three", "four"}
+	for _, body := range bodies {
+		_, err := alice.SendTo(context.Background(), bob.SessionID(), body)
+		if err != nil {
+			t.Fatalf("send failed: %s", err.Error())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := bob.Subscribe(ctx)
+	second := bob.Subscribe(ctx)
+	got := make(map[string]int)
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(bodies) {
+		select {
+		case msg := <-first.Messages:
+			got[*msg.Body()]++
+		case msg := <-second.Messages:
+			got[*msg.Body()]++
+		case <-timeout:
+			t.Fatalf("timed out, got %v", got)
+		}
+	}
+	// give the pollers a few more rounds to deliver anything twice
+	settle := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case msg := <-first.Messages:
+			got[*msg.Body()]++
+		case msg := <-second.Messages:
+			got[*msg.Body()]++
+		case <-settle:
+			done = true
+		}
+	}
+	for body, n := range got {
+		if n != 1 {
+			t.Fatalf("%q delivered %d times", body, n)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/majestrate/ubw/lib/swarm"
+	"sync"
+)
+
+var ErrNoSwarm = errors.New("no service nodes known for swarm")
+
+type cachedSwarm struct {
+	members []swarm.ServiceNode
+	/// version is the snode list version the members were resolved from
+	version uint64
+}
+
+/// swarmCache remembers the swarm for each session id we talk to so we ask its members directly
+type swarmCache struct {
+	mtx    sync.Mutex
+	swarms map[string]*cachedSwarm
+}
+
+/// get returns the cached swarm for id, resolving it from snodes when there is none or the snode list changed since
+func (c *swarmCache) get(snodes *SnodeMap, id string) []swarm.ServiceNode {
+	version := snodes.Version()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cached, ok := c.swarms[id]
+	if !ok || cached.version != version || len(cached.members) == 0 {
+		cached = &cachedSwarm{members: snodes.SwarmFor(id), version: version}
+		if c.swarms == nil {
+			c.swarms = make(map[string]*cachedSwarm)
+		}
+		c.swarms[id] = cached
+	}
+	return cached.members
+}
+
+/// set replaces the cached swarm for id, used when a node tells us the swarm moved
+func (c *swarmCache) set(snodes *SnodeMap, id string, members []swarm.ServiceNode) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.swarms == nil {
+		c.swarms = make(map[string]*cachedSwarm)
+	}
+	c.swarms[id] = &cachedSwarm{members: members, version: snodes.Version()}
+}
+
+/// followRedirect returns the swarm for id after a member said it moved to redirect, keeping and caching only the nodes we know
+/// a redirect naming no node we know could point anywhere, so the swarm is resolved from our snode list instead and not cached
+func (cl *Client) followRedirect(id string, redirect []swarm.ServiceNode) []swarm.ServiceNode {
+	known := cl.snodes.Known(redirect)
+	if len(known) == 0 {
+		return cl.snodes.SwarmFor(id)
+	}
+	cl.swarms.set(&cl.snodes, id, known)
+	return known
+}
+
+/// withSwarm calls fn with members of the swarm for id until one succeeds, healthy members are tried first
+/// if a member says the swarm moved the new members are tried instead, see followRedirect
+func (cl *Client) withSwarm(ctx context.Context, id string, fn func(swarm.ServiceNode) error) error {
+	members := cl.snodes.Order(cl.swarms.get(&cl.snodes, id))
+	if len(members) == 0 {
+		return ErrNoSwarm
+	}
+	var err error
+	redirected := false
+	for idx := 0; idx < len(members); idx++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		node, done, viaErr := cl.via(members[idx])
+		if viaErr != nil {
+			return viaErr
+		}
+		err = fn(node)
+		done(err)
+		if err == nil {
+			return nil
+		}
+		var wrongSwarm *swarm.WrongSwarmError
+		if errors.As(err, &wrongSwarm) && !redirected && len(wrongSwarm.Swarm) > 0 {
+			redirected = true
+			members = cl.snodes.Order(cl.followRedirect(id, wrongSwarm.Swarm))
+			idx = -1
+		}
+	}
+	return err
+}
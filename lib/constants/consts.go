@@ -3,5 +3,8 @@ package constants
 /// TTL is the number of seconds that we want to store messages for by default
 const TTL = 60 * 60 * 24 * 14
 
+/// TTLMillis is TTL in milliseconds, which is what the storage server takes
+const TTLMillis = TTL * 1000
+
 /// interval in seconds to refresh the snode list
 const SNodeMapUpdateInterval = 60 * 2
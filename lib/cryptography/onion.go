@@ -0,0 +1,96 @@
+package cryptography
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"golang.org/x/crypto/curve25519"
+)
+
+const gcmNonceSize = 12
+
+var onionSalt = []byte("LOKI")
+
+/// DeriveSymmetricKey derives the aes-gcm key used between an x25519 secret key and a peer's x25519 public key the same way the storage server does
+func DeriveSymmetricKey(secret, public []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(secret, public)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, onionSalt)
+	mac.Write(shared)
+	return mac.Sum(nil), nil
+}
+
+/// EncryptGCM encrypts data with aes-gcm, the random nonce is prepended to the ciphertext
+func EncryptGCM(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcmNonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+/// DecryptGCM decrypts data made by EncryptGCM
+func DecryptGCM(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcmNonceSize+aead.Overhead() {
+		return nil, ErrDecryptError
+	}
+	plain, err := aead.Open(nil, data[:gcmNonceSize], data[gcmNonceSize:], nil)
+	if err != nil {
+		return nil, ErrDecryptError
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/// OnionLayer is one layer of an onion request encrypted to a single hop
+type OnionLayer struct {
+	Ciphertext   []byte
+	EphemeralKey []byte
+	SymmetricKey []byte
+}
+
+/// EncryptForX25519 encrypts data to an x25519 public key using a fresh ephemeral key
+func EncryptForX25519(public, data []byte) (*OnionLayer, error) {
+	secret := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	key, err := DeriveSymmetricKey(secret, public)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := EncryptGCM(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return &OnionLayer{
+		Ciphertext:   ct,
+		EphemeralKey: ephemeral,
+		SymmetricKey: key,
+	}, nil
+}
@@ -0,0 +1,64 @@
+package cryptography
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+/// StorageKeySize is the size of a key for SealSecret and OpenSecret
+const StorageKeySize = 32
+
+/// storageKeyPersonal separates the storage key from anything else derived from the seed
+const storageKeyPersonal = "ubw storage key"
+
+const nonceSize = 24
+
+/// StorageKey derives a key for encrypting our local database from our seed
+func (keys *KeyPair) StorageKey() *[StorageKeySize]byte {
+	h, _ := blake2b.New256(keys.secretKey.Seed())
+	h.Write([]byte(storageKeyPersonal))
+	key := new([StorageKeySize]byte)
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+/// PassphraseKey derives a key for encrypting our local database from a passphrase with argon2id, salted with our session id
+func (keys *KeyPair) PassphraseKey(passphrase string) *[StorageKeySize]byte {
+	key := new([StorageKeySize]byte)
+	copy(key[:], argon2.IDKey([]byte(passphrase), []byte(storageKeyPersonal+keys.SessionID()), 1, 64*1024, 4, StorageKeySize))
+	return key
+}
+
+/// SealSecret encrypts and authenticates data with key under a random nonce
+func SealSecret(key *[StorageKeySize]byte, data []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, key), nil
+}
+
+/// OpenSecret decrypts data sealed by SealSecret with the same key
+func OpenSecret(key *[StorageKeySize]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize+secretbox.Overhead {
+		return nil, ErrDecryptError
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	data, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, ErrDecryptError
+	}
+	return data, nil
+}
+
+/// SecretTag returns a keyed hash of data so equal values can be matched without being revealed
+func SecretTag(key *[StorageKeySize]byte, data string) string {
+	h, _ := blake2b.New256(key[:])
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"github.com/majestrate/ubw/lib/protobuf"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+/// Builder fills in an outgoing DataMessage one feature at a time, every method returns the builder so calls can be chained
+type Builder struct {
+	msg *protobuf.DataMessage
+}
+
+/// NewMessage starts building an empty message
+func NewMessage() *Builder {
+	return &Builder{msg: new(protobuf.DataMessage)}
+}
+
+/// Body sets the text of the message
+func (b *Builder) Body(body string) *Builder {
+	b.msg.Body = proto.String(body)
+	return b
+}
+
+/// Attach adds attachment pointers, see Client.Upload
+func (b *Builder) Attach(ptrs ...*protobuf.AttachmentPointer) *Builder {
+	b.msg.Attachments = append(b.msg.Attachments, ptrs...)
+	return b
+}
+
+/// Quote quotes an earlier message, id is the quoted message's timestamp in milliseconds and author its sender's session id
+func (b *Builder) Quote(id uint64, author, text string) *Builder {
+	b.msg.Quote = &protobuf.DataMessage_Quote{
+		Id:     proto.Uint64(id),
+		Author: proto.String(author),
+		Text:   proto.String(text),
+	}
+	return b
+}
+
+/// ReplyTo quotes orig, see PlainMessage.ReplyTag
+func (b *Builder) ReplyTo(orig *PlainMessage) *Builder {
+	b.msg.Quote = orig.ReplyTag()
+	return b
+}
+
+/// QuoteAttachment describes an attachment of the quoted message, call it after Quote, thumbnail may be nil
+func (b *Builder) QuoteAttachment(contentType, fileName string, thumbnail *protobuf.AttachmentPointer) *Builder {
+	if b.msg.Quote == nil {
+		b.msg.Quote = new(protobuf.DataMessage_Quote)
+	}
+	b.msg.Quote.Attachments = append(b.msg.Quote.Attachments, &protobuf.DataMessage_Quote_QuotedAttachment{
+		ContentType: proto.String(contentType),
+		FileName:    proto.String(fileName),
+		Thumbnail:   thumbnail,
+	})
+	return b
+}
+
+/// Preview adds a link preview, image may be nil
+func (b *Builder) Preview(url, title string, image *protobuf.AttachmentPointer) *Builder {
+	b.msg.Preview = append(b.msg.Preview, &protobuf.DataMessage_Preview{
+		Url:   proto.String(url),
+		Title: proto.String(title),
+		Image: image,
+	})
+	return b
+}
+
+/// Profile sets the display name and avatar url shown for us, an empty avatar url leaves it unset
+func (b *Builder) Profile(displayName, avatarURL string) *Builder {
+	b.msg.Profile = &protobuf.DataMessage_LokiProfile{DisplayName: proto.String(displayName)}
+	if avatarURL != "" {
+		b.msg.Profile.ProfilePicture = proto.String(avatarURL)
+	}
+	return b
+}
+
+/// ProfileKey sets the key our avatar is encrypted with
+func (b *Builder) ProfileKey(key []byte) *Builder {
+	b.msg.ProfileKey = key
+	return b
+}
+
+/// ExpireTimer asks the recipient to delete the message d after reading it, rounded down to whole seconds
+func (b *Builder) ExpireTimer(d time.Duration) *Builder {
+	b.msg.ExpireTimer = proto.Uint32(uint32(d / time.Second))
+	return b
+}
+
+/// Flags sets flags on the message, in addition to any set already
+func (b *Builder) Flags(flags protobuf.DataMessage_Flags) *Builder {
+	b.msg.Flags = proto.Uint32(b.msg.GetFlags() | uint32(flags))
+	return b
+}
+
+/// Contact adds a contact card
+func (b *Builder) Contact(contact *protobuf.DataMessage_Contact) *Builder {
+	b.msg.Contact = append(b.msg.Contact, contact)
+	return b
+}
+
+/// ContactCard adds a contact card with a display name and mobile numbers
+func (b *Builder) ContactCard(displayName string, numbers ...string) *Builder {
+	contact := &protobuf.DataMessage_Contact{
+		Name: &protobuf.DataMessage_Contact_Name{DisplayName: proto.String(displayName)},
+	}
+	for _, number := range numbers {
+		contact.Number = append(contact.Number, &protobuf.DataMessage_Contact_Phone{
+			Value: proto.String(number),
+			Type:  protobuf.DataMessage_Contact_Phone_MOBILE.Enum(),
+		})
+	}
+	return b.Contact(contact)
+}
+
+/// SyncTarget marks the message as a copy of one we sent to target, for our other devices
+func (b *Builder) SyncTarget(target string) *Builder {
+	b.msg.SyncTarget = proto.String(target)
+	return b
+}
+
+/// Build returns the message, the builder must not be used afterwards
+func (b *Builder) Build() *PlainMessage {
+	return &PlainMessage{Message: b.msg}
+}
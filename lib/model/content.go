@@ -0,0 +1,124 @@
+package model
+
+import (
+	"errors"
+	"github.com/majestrate/ubw/lib/protobuf"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+var ErrEmptyMessage = errors.New("message has no content")
+
+/// ContentKind says which kind of content a PlainMessage carries
+type ContentKind int
+
+const (
+	/// ContentData is a DataMessage, a chat message with a body, attachments or both
+	ContentData ContentKind = iota
+	/// ContentReceipt is a delivery or read receipt for messages we sent
+	ContentReceipt
+	/// ContentTyping is a typing indicator
+	ContentTyping
+	/// ContentConfiguration is a config sync from another of our own devices
+	ContentConfiguration
+	/// ContentUnknown is content we cannot decode, it is left in PlainMessage.Raw
+	ContentUnknown
+)
+
+func (k ContentKind) String() string {
+	switch k {
+	case ContentData:
+		return "data"
+	case ContentReceipt:
+		return "receipt"
+	case ContentTyping:
+		return "typing"
+	case ContentConfiguration:
+		return "configuration"
+	}
+	return "unknown"
+}
+
+/// MakeReceipt makes a receipt for the messages sent at timestamps, see PlainMessage.SentAt
+func MakeReceipt(kind protobuf.ReceiptMessage_Type, timestamps ...uint64) *PlainMessage {
+	return &PlainMessage{
+		Kind: ContentReceipt,
+		Receipt: &protobuf.ReceiptMessage{
+			Type:      kind.Enum(),
+			Timestamp: timestamps,
+		},
+	}
+}
+
+/// MakeTyping makes a typing indicator
+func MakeTyping(action protobuf.TypingMessage_Action) *PlainMessage {
+	return &PlainMessage{
+		Kind: ContentTyping,
+		Typing: &protobuf.TypingMessage{
+			Timestamp: proto.Uint64(uint64(time.Now().UnixNano() / int64(time.Millisecond))),
+			Action:    action.Enum(),
+		},
+	}
+}
+
+/// encodeContent marshals the content of plain, data messages are stamped with now
+/// ErrEmptyMessage is returned if plain has nothing of its kind to send
+func (plain *PlainMessage) encodeContent(now uint64) ([]byte, error) {
+	switch plain.Kind {
+	case ContentUnknown:
+		if len(plain.Raw) == 0 {
+			return nil, ErrEmptyMessage
+		}
+		return plain.Raw, nil
+	case ContentData:
+		if plain.Message == nil {
+			return nil, ErrEmptyMessage
+		}
+		plain.Message.Timestamp = &now
+	case ContentReceipt:
+		if plain.Receipt == nil {
+			return nil, ErrEmptyMessage
+		}
+	case ContentTyping:
+		if plain.Typing == nil {
+			return nil, ErrEmptyMessage
+		}
+	case ContentConfiguration:
+		if plain.Configuration == nil {
+			return nil, ErrEmptyMessage
+		}
+	}
+	return proto.Marshal(&protobuf.Content{
+		DataMessage:          plain.Message,
+		ReceiptMessage:       plain.Receipt,
+		TypingMessage:        plain.Typing,
+		ConfigurationMessage: plain.Configuration,
+	})
+}
+
+/// decodeContent fills in plain from decrypted content, content with none of the kinds we know is kept as ContentUnknown
+func (plain *PlainMessage) decodeContent(data []byte) error {
+	content := new(protobuf.Content)
+	err := proto.Unmarshal(data, content)
+	if err != nil {
+		return err
+	}
+	plain.Raw = data
+	plain.Message = content.GetDataMessage()
+	plain.Receipt = content.GetReceiptMessage()
+	plain.Typing = content.GetTypingMessage()
+	plain.Configuration = content.GetConfigurationMessage()
+	switch {
+	case plain.Message != nil:
+		plain.Kind = ContentData
+	case plain.Receipt != nil:
+		plain.Kind = ContentReceipt
+	case plain.Typing != nil:
+		plain.Kind = ContentTyping
+	case plain.Configuration != nil:
+		plain.Kind = ContentConfiguration
+	default:
+		plain.Kind = ContentUnknown
+	}
+	return nil
+}
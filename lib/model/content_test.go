@@ -0,0 +1,33 @@
+package model
+
+import (
+	"github.com/majestrate/ubw/lib/protobuf"
+	"testing"
+)
+
+func TestEncodeEmptyContent(t *testing.T) {
+	for _, kind := range []ContentKind{ContentData, ContentReceipt, ContentTyping, ContentConfiguration, ContentUnknown} {
+		plain := &PlainMessage{Kind: kind}
+		if _, err := plain.encodeContent(1000); err != ErrEmptyMessage {
+			t.Fatalf("empty %s content gave %v", kind, err)
+		}
+	}
+}
+
+func TestEncodeContentRoundTrip(t *testing.T) {
+	for _, plain := range []*PlainMessage{
+		MakeReceipt(protobuf.ReceiptMessage_READ, 1000, 2000),
+		MakeTyping(protobuf.TypingMessage_STARTED),
+		MakePlain("hello"),
+	} {
+		data, err := plain.encodeContent(1000)
+		if err != nil {
+			t.Fatalf("encoding %s content failed: %s", plain.Kind, err.Error())
+		}
+		decoded := new(PlainMessage)
+		err = decoded.decodeContent(data)
+		if err != nil || decoded.Kind != plain.Kind {
+			t.Fatalf("%s content decoded as %s: %v", plain.Kind, decoded.Kind, err)
+		}
+	}
+}
@@ -14,6 +14,13 @@ type Message struct {
 	Raw       []byte
 	Hash      string
 	Timestamp string
+	/// Expiration is when the server drops the message, in milliseconds like Timestamp
+	Expiration string
+	/// Owner is the session id whose swarm the message was fetched from
+	Owner string
+	/// From and SentAt are filled in from the decrypted message before it is stored, SentAt is in milliseconds
+	From   string
+	SentAt uint64
 }
 
 func (msg *Message) decodeRaw() ([]byte, error) {
@@ -30,9 +37,16 @@ func (msg *Message) decodeRaw() ([]byte, error) {
 	return env.Content, nil
 }
 
+/// PlainMessage is decrypted content, Kind says which of Message, Receipt, Typing or Configuration is set
 type PlainMessage struct {
-	Message *protobuf.DataMessage
-	From    string
+	Kind          ContentKind
+	Message       *protobuf.DataMessage
+	Receipt       *protobuf.ReceiptMessage
+	Typing        *protobuf.TypingMessage
+	Configuration *protobuf.ConfigurationMessage
+	/// Raw is the decrypted content as received, it is the only way to read content of kind ContentUnknown
+	Raw  []byte
+	From string
 }
 
 func (plain *PlainMessage) Body() *string {
@@ -42,6 +56,14 @@ func (plain *PlainMessage) Body() *string {
 	return plain.Message.Body
 }
 
+/// Attachments returns the attachment pointers sent with the message
+func (plain *PlainMessage) Attachments() []*protobuf.AttachmentPointer {
+	if plain.Message == nil {
+		return nil
+	}
+	return plain.Message.Attachments
+}
+
 func (plain *PlainMessage) When() time.Time {
 	t := int64(0)
 	if plain.Message != nil && plain.Message.Timestamp != nil {
@@ -50,8 +72,31 @@ func (plain *PlainMessage) When() time.Time {
 	return time.Unix(t, 0)
 }
 
-func (plain *PlainMessage) ReplyTag() []byte {
-	return nil
+/// SentAt returns the sender's timestamp in milliseconds, quotes use it to name the message
+func (plain *PlainMessage) SentAt() uint64 {
+	if plain.Message == nil {
+		return 0
+	}
+	return plain.Message.GetTimestamp()
+}
+
+/// ReplyTag returns a quote of the message to put in a reply, it is nil if the message has no timestamp or sender to quote it by
+func (plain *PlainMessage) ReplyTag() *protobuf.DataMessage_Quote {
+	if plain.SentAt() == 0 || plain.From == "" {
+		return nil
+	}
+	quote := &protobuf.DataMessage_Quote{
+		Id:     proto.Uint64(plain.SentAt()),
+		Author: proto.String(plain.From),
+		Text:   plain.Body(),
+	}
+	for _, att := range plain.Attachments() {
+		quote.Attachments = append(quote.Attachments, &protobuf.DataMessage_Quote_QuotedAttachment{
+			ContentType: att.ContentType,
+			FileName:    att.FileName,
+		})
+	}
+	return quote
 }
 
 var wsVerb = "PUT"
@@ -63,11 +108,7 @@ var wsType = protobuf.WebSocketMessage_REQUEST.Enum()
 
 func (msg *PlainMessage) Encrypt(keys *cryptography.KeyPair, to string) ([]byte, error) {
 	now := uint64(time.Now().UnixNano() / 1000000)
-	msg.Message.Timestamp = &now
-	content := protobuf.Content{
-		DataMessage: msg.Message,
-	}
-	data, err := proto.Marshal(&content)
+	data, err := msg.encodeContent(now)
 	if err != nil {
 		return nil, err
 	}
@@ -105,11 +146,7 @@ func (msg *PlainMessage) Encrypt(keys *cryptography.KeyPair, to string) ([]byte,
 }
 
 func MakePlain(data string) *PlainMessage {
-	return &PlainMessage{
-		Message: &protobuf.DataMessage{
-			Body: &data,
-		},
-	}
+	return NewMessage().Body(data).Build()
 }
 
 func (msg *Message) Decrypt(keys *cryptography.KeyPair) (*PlainMessage, error) {
@@ -122,12 +159,10 @@ func (msg *Message) Decrypt(keys *cryptography.KeyPair) (*PlainMessage, error) {
 		return nil, fmt.Errorf("decrypt and verify failed: %s", err.Error())
 	}
 	plain := new(PlainMessage)
-	content := &protobuf.Content{}
 	plain.From = fmt.Sprintf("05%s", hex.EncodeToString(from))
-	err = proto.Unmarshal(data, content)
+	err = plain.decodeContent(data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode inner content: %s", err.Error())
 	}
-	plain.Message = content.GetDataMessage()
 	return plain, nil
 }
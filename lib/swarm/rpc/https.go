@@ -1 +1,66 @@
 package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+/// DefaultClient is the shared http client used when an RPC has none set
+var DefaultClient = NewHTTPClient(nil)
+
+/// DefaultCAClient is the shared CA verifying http client used when an RPC needs one and has none set
+var DefaultCAClient = NewCAHTTPClient(nil)
+
+/// HTTPS makes json rpc calls by posting directly to an endpoint
+type HTTPS struct {
+	URL    *url.URL
+	Client *http.Client
+	/// IdentityKey is the service node's identity key the endpoint's certificate is pinned to if Pins is set
+	IdentityKey string
+	/// Pins checks the endpoint's certificate against IdentityKey during the tls handshake if set, Client is not used then
+	Pins *Pinner
+}
+
+func (h *HTTPS) do(req *http.Request) (*http.Response, error) {
+	if h.Pins != nil {
+		return h.Pins.Do(req, h.IdentityKey)
+	}
+	if h.Client == nil {
+		return DefaultClient.Do(req)
+	}
+	return h.Client.Do(req)
+}
+
+func (h *HTTPS) Call(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+	body, err := EncodeRequest(method, params)
+	if err != nil {
+		return nil, err
+	}
+	return h.post(ctx, "application/json", body)
+}
+
+func (h *HTTPS) post(ctx context.Context, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := h.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("post failed: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: data}
+	}
+	return data, nil
+}
@@ -0,0 +1,179 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"net/http"
+	"net/url"
+)
+
+/// ErrPathFailed is wrapped by errors from an onion path that happen before the destination node answered
+var ErrPathFailed = errors.New("onion path failed")
+
+/// Hop is a service node an onion request is relayed through or sent to
+type Hop struct {
+	/// Address is the host:port of the node's storage server
+	Address       string
+	IdentityKey   string
+	EncryptionKey string
+}
+
+/// Onion makes storage rpc calls to Target through a path of relaying hops using /onion_req/v2
+type Onion struct {
+	/// Path is the list of relaying hops, the first hop is the guard
+	Path   []Hop
+	Target Hop
+	Client *http.Client
+	/// Pins checks the guard's certificate against its identity key if set
+	Pins *Pinner
+}
+
+/// EncodeOnionPayload frames a ciphertext and its json metadata the way /onion_req/v2 expects
+func EncodeOnionPayload(ciphertext []byte, meta map[string]interface{}) ([]byte, error) {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4, 4+len(ciphertext)+len(metaJSON))
+	binary.LittleEndian.PutUint32(buf, uint32(len(ciphertext)))
+	buf = append(buf, ciphertext...)
+	return append(buf, metaJSON...), nil
+}
+
+/// DecodeOnionPayload splits a /onion_req/v2 payload into its ciphertext and json metadata
+func DecodeOnionPayload(data []byte) (ciphertext []byte, meta map[string]interface{}, err error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("onion payload too short")
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if uint64(size) > uint64(len(data)-4) {
+		return nil, nil, errors.New("onion payload size mismatch")
+	}
+	ciphertext = data[4 : 4+size]
+	meta = make(map[string]interface{})
+	err = json.Unmarshal(data[4+size:], &meta)
+	return
+}
+
+/// pathError is a guard failure, it matches ErrPathFailed and wraps the underlying error
+type pathError struct {
+	err error
+}
+
+func (e *pathError) Error() string {
+	return fmt.Sprintf("%s: guard request failed: %s", ErrPathFailed.Error(), e.err.Error())
+}
+
+func (e *pathError) Is(target error) bool {
+	return target == ErrPathFailed
+}
+
+func (e *pathError) Unwrap() error {
+	return e.err
+}
+
+type onionResponse struct {
+	Body   string `json:"body"`
+	Status int    `json:"status"`
+}
+
+func hexKey(key string) ([]byte, error) {
+	data, err := hex.DecodeString(key)
+	if err != nil || len(data) != 32 {
+		return nil, fmt.Errorf("invalid x25519 key %q", key)
+	}
+	return data, nil
+}
+
+/// build wraps a request for the target in one layer per hop, returning the guard payload and the key the reply is encrypted with
+func (o *Onion) build(request []byte) ([]byte, []byte, error) {
+	dstKey, err := hexKey(o.Target.EncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	layer, err := cryptography.EncryptForX25519(dstKey, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	replyKey := layer.SymmetricKey
+	next := o.Target
+	for idx := len(o.Path) - 1; idx >= 0; idx-- {
+		hop := o.Path[idx]
+		payload, err := EncodeOnionPayload(layer.Ciphertext, map[string]interface{}{
+			"destination":   next.IdentityKey,
+			"ephemeral_key": hex.EncodeToString(layer.EphemeralKey),
+			"enc_type":      "aes-gcm",
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		hopKey, err := hexKey(hop.EncryptionKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		layer, err = cryptography.EncryptForX25519(hopKey, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		next = hop
+	}
+	payload, err := EncodeOnionPayload(layer.Ciphertext, map[string]interface{}{
+		"ephemeral_key": hex.EncodeToString(layer.EphemeralKey),
+		"enc_type":      "aes-gcm",
+	})
+	return payload, replyKey, err
+}
+
+func (o *Onion) Call(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+	if len(o.Path) == 0 {
+		return nil, fmt.Errorf("%w: empty path", ErrPathFailed)
+	}
+	request, err := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, replyKey, err := o.build(request)
+	if err != nil {
+		return nil, err
+	}
+	guard := &HTTPS{
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   o.Path[0].Address,
+			Path:   "/onion_req/v2",
+		},
+		Client:      o.Client,
+		IdentityKey: o.Path[0].IdentityKey,
+		Pins:        o.Pins,
+	}
+	body, err := guard.post(ctx, "application/octet-stream", payload)
+	if err != nil {
+		return nil, &pathError{err: err}
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		ciphertext = body
+	}
+	plain, err := cryptography.DecryptGCM(replyKey, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not decrypt response: %s", ErrPathFailed, err.Error())
+	}
+	var inner onionResponse
+	err = json.Unmarshal(plain, &inner)
+	if err != nil {
+		return nil, fmt.Errorf("bad onion response: %s", err.Error())
+	}
+	if inner.Status != http.StatusOK && inner.Status != 0 {
+		return nil, &StatusError{StatusCode: inner.Status, Body: []byte(inner.Body)}
+	}
+	return json.RawMessage(inner.Body), nil
+}
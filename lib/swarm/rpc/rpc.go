@@ -1,5 +1,93 @@
 package rpc
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/// RPC makes a json rpc call and returns the raw response body
 type RPC interface {
-	Call(method string, params map[string]interface{})
+	Call(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error)
+}
+
+/// Func adapts a plain function to an RPC, handy for fakes in tests
+type Func func(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error)
+
+func (f Func) Call(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+	return f(ctx, method, params)
+}
+
+/// Middleware wraps an RPC to add behaviour such as retries or logging
+type Middleware func(RPC) RPC
+
+/// Chain wraps r in middleware, the first middleware is the outermost
+func Chain(r RPC, middleware ...Middleware) RPC {
+	for idx := len(middleware) - 1; idx >= 0; idx-- {
+		r = middleware[idx](r)
+	}
+	return r
+}
+
+/// StatusError is returned when the remote end answers with a non 200 status
+type StatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("rpc returned status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+/// EncodeRequest makes the json rpc request body for a call
+func EncodeRequest(method string, params map[string]interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      0,
+		"method":  method,
+		"params":  params,
+	})
+}
+
+/// WithRetry retries failed calls up to attempts times in total, waiting backoff between tries, status errors are not retried
+func WithRetry(attempts int, backoff time.Duration) Middleware {
+	return func(next RPC) RPC {
+		return Func(func(ctx context.Context, method string, params map[string]interface{}) (result json.RawMessage, err error) {
+			for try := 0; try < attempts || try == 0; try++ {
+				if try > 0 {
+					select {
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					case <-time.After(backoff):
+					}
+				}
+				result, err = next.Call(ctx, method, params)
+				if err == nil {
+					return
+				}
+				if _, ok := err.(*StatusError); ok {
+					return
+				}
+			}
+			return
+		})
+	}
+}
+
+/// WithLogging logs every call, its duration and its error with logf
+func WithLogging(logf func(format string, args ...interface{})) Middleware {
+	return func(next RPC) RPC {
+		return Func(func(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+			started := time.Now()
+			result, err := next.Call(ctx, method, params)
+			if err != nil {
+				logf("rpc %s failed after %s: %s", method, time.Since(started), err.Error())
+			} else {
+				logf("rpc %s took %s", method, time.Since(started))
+			}
+			return result, err
+		})
+	}
 }
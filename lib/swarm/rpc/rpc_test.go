@@ -0,0 +1,119 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryMiddleware(t *testing.T) {
+	calls := 0
+	flaky := Func(func(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("timed out")
+		}
+		return json.RawMessage(`{}`), nil
+	})
+	var logged []string
+	r := Chain(flaky, WithLogging(func(format string, args ...interface{}) {
+		logged = append(logged, format)
+	}), WithRetry(3, 0))
+	_, err := r.Call(context.Background(), "retrieve", nil)
+	if err != nil {
+		t.Fatalf("call failed: %s", err.Error())
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+	if len(logged) != 1 {
+		t.Fatalf("expected 1 log line, got %d", len(logged))
+	}
+
+	calls = 0
+	rejected := Func(func(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+		calls++
+		return nil, &StatusError{StatusCode: 400}
+	})
+	_, err = Chain(rejected, WithRetry(3, 0)).Call(context.Background(), "retrieve", nil)
+	if _, ok := err.(*StatusError); !ok || calls != 1 {
+		t.Fatalf("status errors should not be retried, got %v after %d calls", err, calls)
+	}
+}
+
+/// selfSigned makes a fresh self signed certificate, httptest servers all share one
+func selfSigned(t *testing.T) tls.Certificate {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+/// signedServer starts a tls server that signs its certificate with secret like a storage server and counts the posts it gets, a nil secret leaves responses unsigned
+func signedServer(t *testing.T, secret ed25519.PrivateKey, posts *int32) *httptest.Server {
+	var signature string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signature != "" {
+			w.Header().Set(SignatureHeader, signature)
+		}
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(posts, 1)
+		}
+		w.Write([]byte("{}"))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	srv.StartTLS()
+	if secret != nil {
+		signature = CertificateSignature(secret, srv.Certificate().Raw)
+	}
+	return srv
+}
+
+func TestPinnedHandshake(t *testing.T) {
+	pub, secret, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	var posts, impostorPosts int32
+	srv := signedServer(t, secret, &posts)
+	defer srv.Close()
+	impostor := signedServer(t, nil, &impostorPosts)
+	defer impostor.Close()
+	pins := NewPinner(nil)
+	endpoint := func(rawURL string, identity ed25519.PublicKey) *HTTPS {
+		u, _ := url.Parse(rawURL + "/storage_rpc/v1")
+		return &HTTPS{URL: u, IdentityKey: hex.EncodeToString(identity), Pins: pins}
+	}
+
+	_, err := endpoint(srv.URL, pub).Call(context.Background(), "retrieve", nil)
+	if err != nil || atomic.LoadInt32(&posts) != 1 {
+		t.Fatalf("pinned call failed after %d posts: %v", posts, err)
+	}
+	_, err = endpoint(srv.URL, other).Call(context.Background(), "retrieve", nil)
+	if !errors.Is(err, ErrCertificate) || atomic.LoadInt32(&posts) != 1 {
+		t.Fatalf("expected certificate error before posting for the wrong identity, got %v after %d posts", err, posts)
+	}
+	// the pin is checked in the handshake, so a node swapping its certificate never sees the request
+	_, err = endpoint(impostor.URL, pub).Call(context.Background(), "retrieve", nil)
+	if !errors.Is(err, ErrCertificate) || atomic.LoadInt32(&impostorPosts) != 0 {
+		t.Fatalf("expected certificate error before posting to an impostor, got %v after %d posts", err, impostorPosts)
+	}
+}
@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+/// HTTPOptions tunes the http client shared by every service node request, zero fields use the defaults
+type HTTPOptions struct {
+	/// MaxIdleConns is the total number of idle keep alive connections kept open, defaults to 100
+	MaxIdleConns int
+	/// MaxIdleConnsPerHost is the number of idle connections kept open per node, defaults to 4
+	MaxIdleConnsPerHost int
+	/// MaxConnsPerHost limits connections to a single node, defaults to 8
+	MaxConnsPerHost int
+	/// IdleConnTimeout is how long an idle connection is kept, defaults to 90 seconds
+	IdleConnTimeout time.Duration
+	/// DialTimeout bounds connecting to a node, defaults to 10 seconds
+	DialTimeout time.Duration
+	/// TLSHandshakeTimeout bounds the tls handshake, defaults to 10 seconds
+	TLSHandshakeTimeout time.Duration
+	/// ResponseHeaderTimeout bounds waiting for a node to start answering, defaults to 30 seconds
+	ResponseHeaderTimeout time.Duration
+	/// Timeout bounds a whole request, defaults to one minute
+	Timeout time.Duration
+}
+
+func orDefault(val, def int) int {
+	if val > 0 {
+		return val
+	}
+	return def
+}
+
+func orDefaultDuration(val, def time.Duration) time.Duration {
+	if val > 0 {
+		return val
+	}
+	return def
+}
+
+/// NewHTTPClient makes a pooling http client for talking to service nodes, opts may be nil
+/// service nodes use self signed certificates so the client does not check them at all, it is only for nodes without an identity key and a Pinner is used for the rest
+func NewHTTPClient(opts *HTTPOptions) *http.Client {
+	return newHTTPClient(opts, &tls.Config{
+		InsecureSkipVerify: true,
+	})
+}
+
+/// NewCAHTTPClient makes a pooling http client that verifies certificates against the system CAs, for seed nodes reached by hostname
+func NewCAHTTPClient(opts *HTTPOptions) *http.Client {
+	return newHTTPClient(opts, &tls.Config{})
+}
+
+func newHTTPClient(opts *HTTPOptions, tlsConfig *tls.Config) *http.Client {
+	if opts == nil {
+		opts = new(HTTPOptions)
+	}
+	dialer := &net.Dialer{
+		Timeout:   orDefaultDuration(opts.DialTimeout, 10*time.Second),
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Timeout: orDefaultDuration(opts.Timeout, time.Minute),
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          orDefault(opts.MaxIdleConns, 100),
+			MaxIdleConnsPerHost:   orDefault(opts.MaxIdleConnsPerHost, 4),
+			MaxConnsPerHost:       orDefault(opts.MaxConnsPerHost, 8),
+			IdleConnTimeout:       orDefaultDuration(opts.IdleConnTimeout, 90*time.Second),
+			TLSHandshakeTimeout:   orDefaultDuration(opts.TLSHandshakeTimeout, 10*time.Second),
+			ResponseHeaderTimeout: orDefaultDuration(opts.ResponseHeaderTimeout, 30*time.Second),
+			TLSClientConfig:       tlsConfig,
+		},
+	}
+}
@@ -0,0 +1,241 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/// SignatureHeader is the response header in which a storage server proves its self signed certificate belongs to its identity key
+const SignatureHeader = "X-Loki-Snode-Signature"
+
+/// ErrCertificate is matched by every certificate verification failure, use errors.Is to count them
+var ErrCertificate = errors.New("certificate verification failed")
+
+/// CertificateError says why a service node's certificate was rejected
+type CertificateError struct {
+	Host   string
+	Reason string
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("%s for %s: %s", ErrCertificate.Error(), e.Host, e.Reason)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return ErrCertificate
+}
+
+/// Verifier checks a response came from the node we meant to talk to
+type Verifier func(resp *http.Response) error
+
+/// CertificateSignature makes the SignatureHeader value for a der encoded certificate, the signature is over the sha256 of the certificate
+func CertificateSignature(secret ed25519.PrivateKey, certDER []byte) string {
+	hash := sha256.Sum256(certDER)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(secret, hash[:]))
+}
+
+/// PinIdentity returns a Verifier that binds the presented certificate to a node's hex encoded ed25519 identity key, Pinner uses it to learn certificates
+func PinIdentity(identityKey string) Verifier {
+	return func(resp *http.Response) error {
+		host := resp.Request.URL.Host
+		pubkey, err := hex.DecodeString(identityKey)
+		if err != nil || len(pubkey) != ed25519.PublicKeySize {
+			return &CertificateError{Host: host, Reason: "invalid identity key"}
+		}
+		if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+			return &CertificateError{Host: host, Reason: "no certificate presented"}
+		}
+		sig, err := base64.StdEncoding.DecodeString(resp.Header.Get(SignatureHeader))
+		if err != nil || len(sig) != ed25519.SignatureSize {
+			return &CertificateError{Host: host, Reason: "missing or malformed certificate signature"}
+		}
+		hash := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+		if !ed25519.Verify(ed25519.PublicKey(pubkey), hash[:], sig) {
+			return &CertificateError{Host: host, Reason: "certificate not signed by identity key"}
+		}
+		return nil
+	}
+}
+
+/// Pinner makes http requests to service nodes that check a node's certificate during the tls handshake, so nothing is sent to a node that cannot prove its identity
+/// a node proves its self signed certificate belongs to its identity key with a signature in the SignatureHeader of every response,
+/// so the first time we talk to a node it is probed with an empty request over a connection that is closed straight after, and the certificate it proved is pinned
+/// oxen storage servers do not send SignatureHeader, so pinning is only for networks whose nodes do such as swarmtest
+type Pinner struct {
+	/// client is shared by every pinned node, its requests are addressed to pinnedHost so each node gets its own connections
+	client           *http.Client
+	probe            *http.Client
+	dialer           *net.Dialer
+	handshakeTimeout time.Duration
+	mtx              sync.Mutex
+	nodes            map[string]*pinnedNode
+}
+
+/// pinnedNode is where a node with a pinned certificate is reached and the certificate it proved
+type pinnedNode struct {
+	identityKey string
+	addr        string
+	/// cert is the sha256 of the pinned certificate, nil until a probe proved one
+	cert []byte
+}
+
+/// pinnedSuffix ends the made up host names pinned requests are addressed to
+const pinnedSuffix = ".snode"
+
+/// DefaultPinner is the shared Pinner used when pinning is turned on without one set
+var DefaultPinner = NewPinner(nil)
+
+/// NewPinner makes a Pinner whose connections are tuned by opts, opts may be nil
+func NewPinner(opts *HTTPOptions) *Pinner {
+	if opts == nil {
+		opts = new(HTTPOptions)
+	}
+	p := &Pinner{
+		probe:            newHTTPClient(opts, &tls.Config{InsecureSkipVerify: true}),
+		dialer:           &net.Dialer{Timeout: orDefaultDuration(opts.DialTimeout, 10*time.Second), KeepAlive: 30 * time.Second},
+		handshakeTimeout: orDefaultDuration(opts.TLSHandshakeTimeout, 10*time.Second),
+		nodes:            make(map[string]*pinnedNode),
+	}
+	// a probe connection is never checked against a pin, so it must not be reused for anything else
+	p.probe.Transport.(*http.Transport).DisableKeepAlives = true
+	p.client = newHTTPClient(opts, nil)
+	transport := p.client.Transport.(*http.Transport)
+	transport.DialTLSContext = p.dialTLS
+	// a proxy would make the transport do the tls handshake itself, without dialTLS
+	transport.Proxy = nil
+	return p
+}
+
+/// pinnedHost names the node with identityKey in urls, the pooled connections of a node are kept apart from those of another node at the same address
+func pinnedHost(identityKey string) string {
+	return identityKey[:32] + "." + identityKey[32:] + pinnedSuffix
+}
+
+/// Do sends req to the node with identityKey at the host of req's url, probing the node for its certificate first if none is pinned yet
+func (p *Pinner) Do(req *http.Request, identityKey string) (*http.Response, error) {
+	if len(identityKey) != 2*ed25519.PublicKeySize {
+		return nil, &CertificateError{Host: req.URL.Host, Reason: "invalid identity key"}
+	}
+	host := pinnedHost(identityKey)
+	p.mtx.Lock()
+	node, ok := p.nodes[host]
+	if !ok {
+		node = &pinnedNode{identityKey: identityKey}
+		p.nodes[host] = node
+	}
+	if node.addr != req.URL.Host {
+		node.addr = req.URL.Host
+		node.cert = nil
+	}
+	cert := node.cert
+	p.mtx.Unlock()
+	if cert == nil {
+		cert, err := p.learn(req.Context(), identityKey, req.URL)
+		if err != nil {
+			return nil, err
+		}
+		p.mtx.Lock()
+		node.cert = cert
+		p.mtx.Unlock()
+	}
+	u := *req.URL
+	_, port, _ := net.SplitHostPort(u.Host)
+	u.Host = net.JoinHostPort(host, port)
+	pinned := req.Clone(req.Context())
+	pinned.URL = &u
+	pinned.Host = req.URL.Host
+	return p.client.Do(pinned)
+}
+
+/// dialTLS connects to the node a pinnedHost address names and checks its certificate against the pin during the handshake
+func (p *Pinner) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mtx.Lock()
+	node, ok := p.nodes[host]
+	var nodeAddr string
+	if ok {
+		nodeAddr = node.addr
+	}
+	p.mtx.Unlock()
+	if !ok {
+		return nil, &CertificateError{Host: addr, Reason: "not a pinned node"}
+	}
+	conn, err := p.dialer.DialContext(ctx, network, nodeAddr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		// the certificate is self signed, VerifyConnection checks it against the pin instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return p.verify(node, nodeAddr, state)
+		},
+	})
+	deadline := time.Now().Add(p.handshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	tlsConn.SetDeadline(deadline)
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+/// verify checks the certificate a connection to node presented is the one pinned for it
+func (p *Pinner) verify(node *pinnedNode, addr string, state tls.ConnectionState) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if node.cert == nil {
+		return &CertificateError{Host: addr, Reason: "no certificate pinned"}
+	}
+	if len(state.PeerCertificates) == 0 {
+		return &CertificateError{Host: addr, Reason: "no certificate presented"}
+	}
+	hash := sha256.Sum256(state.PeerCertificates[0].Raw)
+	if string(hash[:]) != string(node.cert) {
+		// the node may have a new certificate, the next request probes for it again
+		node.cert = nil
+		return &CertificateError{Host: addr, Reason: "certificate does not match the one pinned to its identity key"}
+	}
+	return nil
+}
+
+/// learn probes u with an empty request and returns the sha256 of the certificate the node proved belongs to identityKey
+func (p *Pinner) learn(ctx context.Context, identityKey string, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.probe.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("certificate probe failed: %w", err)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	err = PinIdentity(identityKey)(resp)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+	return hash[:], nil
+}
@@ -1,5 +1,19 @@
 package swarm
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/// SeedNodesEnv is the environment variable that overrides the default seed nodes
+const SeedNodesEnv = "UBW_SEED_NODES"
+
+var ErrBadSeedNode = errors.New("bad seed node")
+
 var seedNodes = []ServiceNode{
 	ServiceNode{
 		RemoteIP:    "public.loki.foundation",
@@ -7,8 +21,46 @@ var seedNodes = []ServiceNode{
 	},
 }
 
-func WithSeedNodes(visit func(ServiceNode)) {
-	for _, node := range seedNodes {
-		visit(node)
+/// DefaultSeedNodes returns a copy of the built in seed node list
+func DefaultSeedNodes() []ServiceNode {
+	return append([]ServiceNode(nil), seedNodes...)
+}
+
+/// ParseSeedNode parses a seed node in the form host:port or ed25519pubkey@host:port
+func ParseSeedNode(str string) (node ServiceNode, err error) {
+	str = strings.TrimPrefix(strings.TrimSpace(str), "https://")
+	if idx := strings.Index(str, "@"); idx >= 0 {
+		node.IdentityKey = str[:idx]
+		str = str[idx+1:]
+	}
+	host, port, err := net.SplitHostPort(str)
+	if err != nil {
+		return node, fmt.Errorf("%w %q: %s", ErrBadSeedNode, str, err.Error())
+	}
+	node.RemoteIP = host
+	node.StoragePort, err = strconv.Atoi(port)
+	if err != nil || node.StoragePort <= 0 || node.StoragePort > 65535 {
+		return node, fmt.Errorf("%w %q: invalid port", ErrBadSeedNode, str)
+	}
+	return node, nil
+}
+
+/// ParseSeedNodes parses a comma or whitespace separated list of seed nodes
+func ParseSeedNodes(str string) (nodes []ServiceNode, err error) {
+	fields := strings.FieldsFunc(str, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	for _, field := range fields {
+		node, err := ParseSeedNode(field)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
 	}
+	return
+}
+
+/// SeedNodesFromEnv returns the seed nodes set in $UBW_SEED_NODES, or nil if it is unset
+func SeedNodesFromEnv() ([]ServiceNode, error) {
+	return ParseSeedNodes(os.Getenv(SeedNodesEnv))
 }
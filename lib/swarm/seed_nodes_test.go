@@ -0,0 +1,26 @@
+package swarm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseSeedNodes(t *testing.T) {
+	nodes, err := ParseSeedNodes("10.0.0.1:22021, abcd@seed.example:443")
+	if err != nil {
+		t.Fatalf("parse failed: %s", err.Error())
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(nodes))
+	}
+	if nodes[0].RemoteIP != "10.0.0.1" || nodes[0].StoragePort != 22021 {
+		t.Fatalf("bad first node: %+v", nodes[0])
+	}
+	if nodes[1].IdentityKey != "abcd" || nodes[1].RemoteIP != "seed.example" || nodes[1].StoragePort != 443 {
+		t.Fatalf("bad second node: %+v", nodes[1])
+	}
+	_, err = ParseSeedNodes("seed.example")
+	if !errors.Is(err, ErrBadSeedNode) {
+		t.Fatalf("expected ErrBadSeedNode, got %v", err)
+	}
+}
@@ -1,8 +1,7 @@
 package swarm
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/base32"
 	"encoding/base64"
 	_ "encoding/hex"
@@ -11,20 +10,30 @@ import (
 	"fmt"
 	"github.com/majestrate/ubw/lib/constants"
 	"github.com/majestrate/ubw/lib/model"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
 	"github.com/majestrate/ubw/lib/utils"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 )
 
+/// WrongSwarmError is returned when a node is not in the swarm for a pubkey, Swarm holds the nodes it told us to ask instead
+type WrongSwarmError struct {
+	Swarm []ServiceNode
+}
+
+func (e *WrongSwarmError) Error() string {
+	return fmt.Sprintf("wrong swarm, redirected to %d nodes", len(e.Swarm))
+}
+
 type ServiceNode struct {
 	RemoteIP      string `json:"public_ip"`
 	StoragePort   int    `json:"storage_port"`
 	IdentityKey   string `json:"pubkey_ed25519"`
 	EncryptionKey string `json:"pubkey_x25519"`
 	SwarmID       uint64 `json:"swarm_id"`
+	transport     Transport
 }
 
 func makeFields(keys ...string) map[string]bool {
@@ -43,42 +52,18 @@ func (node *ServiceNode) StorageURL() *url.URL {
 	return node.URL("/storage_rpc/v1")
 }
 
-func (node *ServiceNode) TLSConfig() *tls.Config {
-	return &tls.Config{
-		InsecureSkipVerify: true,
-	}
-}
-
-func (node *ServiceNode) StorageAPI(method string, params map[string]interface{}) (result map[string]interface{}, err error) {
-	jsonReq := map[string]interface{}{
-		"jsonrpc": "2.0",
-		"id":      0,
-		"method":  method,
-		"params":  params,
-	}
-	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(jsonReq)
-
-	client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: node.TLSConfig(),
-		},
-	}
-
-	resp, err := client.Post(node.StorageURL().String(), "application/json", body)
-	if err != nil {
-		err = fmt.Errorf("post failed: %s", err.Error())
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	responseBody := new(bytes.Buffer)
-	_, err = io.Copy(responseBody, resp.Body)
+func (node *ServiceNode) StorageAPI(ctx context.Context, method string, params map[string]interface{}) (result map[string]interface{}, err error) {
+	raw, err := node.getTransport().Storage(node).Call(ctx, method, params)
 	if err != nil {
-		return nil, err
+		statusErr, ok := err.(*rpc.StatusError)
+		if !ok || statusErr.StatusCode != http.StatusMisdirectedRequest {
+			return nil, err
+		}
+		// wrong swarm, the body holds the nodes we should ask instead
+		raw = statusErr.Body
 	}
 	jsonResponse := make(map[string]interface{})
-	err = json.NewDecoder(responseBody).Decode(&jsonResponse)
+	err = json.Unmarshal(raw, &jsonResponse)
 	if err != nil {
 		err = fmt.Errorf("response decode failed: %s", err.Error())
 		return nil, err
@@ -106,14 +91,25 @@ func (node *ServiceNode) URL(path string) *url.URL {
 	}
 }
 
+/// jsonString formats a decoded json value as a string, numbers are formatted as integers and missing values are empty
+func jsonString(val interface{}) string {
+	if val == nil {
+		return ""
+	}
+	if num, ok := val.(float64); ok {
+		return strconv.FormatInt(int64(num), 10)
+	}
+	return fmt.Sprintf("%s", val)
+}
+
 func decodeSNodes(snodes interface{}) (infos []*ServiceNode) {
-	snode_list := snodes.([]interface{})
+	snode_list, _ := snodes.([]interface{})
 	for _, snode_info := range snode_list {
 		snode, ok := snode_info.(map[string]interface{})
 		if !ok {
 			continue
 		}
-		port, err := strconv.Atoi(fmt.Sprintf("%s", snode["port"]))
+		port, err := strconv.Atoi(jsonString(snode["port"]))
 		if err != nil {
 			continue
 		}
@@ -127,48 +123,83 @@ func decodeSNodes(snodes interface{}) (infos []*ServiceNode) {
 	return
 }
 
-func (node *ServiceNode) StoreMessage(sessionID string, msg model.Message) (*ServiceNode, error) {
+/// StoreMessage stores msg for sessionID, following the node's redirect if it is not in the swarm, the node that took the message is returned
+func (node *ServiceNode) StoreMessage(ctx context.Context, sessionID string, msg model.Message) (*ServiceNode, error) {
+	err := node.Store(ctx, sessionID, msg)
+	wrongSwarm, ok := err.(*WrongSwarmError)
+	if !ok {
+		if err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	for _, snode := range wrongSwarm.Swarm {
+		stored, err := snode.StoreMessage(ctx, sessionID, msg)
+		if err == nil {
+			return stored, nil
+		}
+	}
+	return nil, errors.New("could not store")
+}
+
+/// Store stores msg for sessionID on this node only, a *WrongSwarmError is returned if it is not in the swarm
+func (node *ServiceNode) Store(ctx context.Context, sessionID string, msg model.Message) error {
 	request := map[string]interface{}{
 		"pubKey":    sessionID,
-		"ttl":       fmt.Sprintf("%d", constants.TTL),
+		"ttl":       fmt.Sprintf("%d", constants.TTLMillis),
 		"timestamp": fmt.Sprintf("%d", utils.TimeNow()),
 		"data":      base64.StdEncoding.EncodeToString(msg.Raw),
 	}
-	result, err := node.StorageAPI("store", request)
-	if err == nil {
-		snodes_obj, ok := result["snodes"]
-		if !ok {
-			return node, nil
-		}
-		for _, snode := range decodeSNodes(snodes_obj) {
-			_, err = snode.StoreMessage(sessionID, msg)
-			if err == nil {
-				return snode, nil
-			}
+	result, err := node.StorageAPI(ctx, "store", request)
+	if err != nil {
+		return err
+	}
+	if snodes, ok := result["snodes"]; ok {
+		return node.wrongSwarm(snodes)
+	}
+	return nil
+}
+
+/// wrongSwarm makes the error for a redirect to snodes, the redirected nodes are reached the same way as node
+func (node *ServiceNode) wrongSwarm(snodes interface{}) *WrongSwarmError {
+	wrongSwarm := new(WrongSwarmError)
+	for _, snode := range decodeSNodes(snodes) {
+		snode.transport = node.transport
+		wrongSwarm.Swarm = append(wrongSwarm.Swarm, *snode)
+	}
+	return wrongSwarm
+}
+
+/// FetchMessages fetches messages for sessionID newer than lastHash, following the node's redirect if it is not in the swarm
+func (node *ServiceNode) FetchMessages(ctx context.Context, sessionID string, lastHash string) ([]model.Message, error) {
+	msgs, err := node.Retrieve(ctx, sessionID, lastHash)
+	wrongSwarm, ok := err.(*WrongSwarmError)
+	if !ok {
+		return msgs, err
+	}
+	for _, snode := range wrongSwarm.Swarm {
+		msgs, err = snode.FetchMessages(ctx, sessionID, lastHash)
+		if err == nil {
+			return msgs, nil
 		}
-		err = errors.New("could not store")
 	}
 	return nil, err
 }
 
-func (node *ServiceNode) FetchMessages(sessionID string, lastHash string) ([]model.Message, error) {
+/// Retrieve fetches messages for sessionID newer than lastHash from this node only, a *WrongSwarmError is returned if it is not in the swarm
+func (node *ServiceNode) Retrieve(ctx context.Context, sessionID string, lastHash string) ([]model.Message, error) {
 	request := map[string]interface{}{
 		"pubKey":   sessionID,
 		"lastHash": lastHash,
 	}
-	result, err := node.StorageAPI("retrieve", request)
+	result, err := node.StorageAPI(ctx, "retrieve", request)
 	if err != nil {
 		return nil, err
 	}
 	var messages []model.Message
 	snodes, ok := result["snodes"]
 	if ok {
-		for _, snode := range decodeSNodes(snodes) {
-			msgs, err := snode.FetchMessages(sessionID, lastHash)
-			if err == nil {
-				return msgs, nil
-			}
-		}
+		return nil, node.wrongSwarm(snodes)
 	}
 
 	msgs, ok := result["messages"]
@@ -188,12 +219,13 @@ func (node *ServiceNode) FetchMessages(sessionID string, lastHash string) ([]mod
 		if err != nil {
 			return nil, err
 		}
-		hash := fmt.Sprintf("%s", m["hash"])
-		timestamp := fmt.Sprintf("%s", m["timestamp"])
+		hash := jsonString(m["hash"])
 		messages = append(messages, model.Message{
-			Raw:       data,
-			Hash:      hash,
-			Timestamp: timestamp,
+			Raw:        data,
+			Hash:       hash,
+			Timestamp:  jsonString(m["timestamp"]),
+			Expiration: jsonString(m["expiration"]),
+			Owner:      sessionID,
 		})
 	}
 	return messages, nil
@@ -207,42 +239,40 @@ type serviceNodeListResponse struct {
 	Result serviceNodeResult `json:"result"`
 }
 
-/// GetSNodeList fetches from this service node a list of all known service nodes
-func (node *ServiceNode) GetSNodeList() ([]ServiceNode, error) {
-
-	jsonBody := map[string]interface{}{
+/// snodeListParams asks oxend for the fields of every active service node we use
+func snodeListParams() map[string]interface{} {
+	return map[string]interface{}{
 		"active_only": true,
 		"fields":      makeFields("public_ip", "storage_port", "pubkey_ed25519", "pubkey_x25519", "swarm_id"),
 	}
-	jsonReq := map[string]interface{}{
-		"jsonrpc": "2.0",
-		"id":      0,
-		"method":  "get_n_service_nodes",
-		"params":  jsonBody,
-	}
-
-	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(jsonReq)
+}
 
-	client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: node.TLSConfig(),
-		},
+func decodeSNodeList(raw []byte) ([]ServiceNode, error) {
+	var response serviceNodeListResponse
+	err := json.Unmarshal(raw, &response)
+	if err != nil {
+		return nil, err
 	}
+	return response.Result.Nodes, nil
+}
 
-	resp, err := client.Post(node.RPCURL().String(), "application/json", body)
-
+/// GetSNodeList fetches a list of all known service nodes from this node's oxend json rpc, only seed nodes serve it on their https port
+func (node *ServiceNode) GetSNodeList(ctx context.Context) ([]ServiceNode, error) {
+	raw, err := node.getTransport().JSONRPC(node).Call(ctx, "get_n_service_nodes", snodeListParams())
 	if err != nil {
 		return nil, err
 	}
+	return decodeSNodeList(raw)
+}
 
-	var response = serviceNodeListResponse{}
-
-	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&response)
+/// FetchSNodeList fetches a list of all known service nodes through this node's storage server, which passes the request on to its oxend
+func (node *ServiceNode) FetchSNodeList(ctx context.Context) ([]ServiceNode, error) {
+	raw, err := node.getTransport().Storage(node).Call(ctx, "oxend_request", map[string]interface{}{
+		"endpoint": "get_service_nodes",
+		"params":   snodeListParams(),
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	return response.Result.Nodes, nil
+	return decodeSNodeList(raw)
 }
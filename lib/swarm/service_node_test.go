@@ -0,0 +1,290 @@
+package swarm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/majestrate/ubw/lib/model"
+	"github.com/majestrate/ubw/lib/swarm"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
+	"github.com/majestrate/ubw/lib/swarm/swarmtest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testPubkey = "050123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestGetSNodeList(t *testing.T) {
+	net := swarmtest.NewNetwork(2, 3)
+	defer net.Close()
+
+	seed := net.Seed()
+	nodes, err := seed.GetSNodeList(context.Background())
+	if err != nil {
+		t.Fatalf("get snode list failed: %s", err.Error())
+	}
+	if len(nodes) != 6 {
+		t.Fatalf("expected 6 nodes, got %d", len(nodes))
+	}
+}
+
+func TestFetchSNodeList(t *testing.T) {
+	net := swarmtest.NewNetwork(2, 3)
+	defer net.Close()
+
+	node := net.Nodes()[len(net.Nodes())-1]
+	if _, err := node.GetSNodeList(context.Background()); err == nil {
+		t.Fatalf("storage server answered the oxend json rpc")
+	}
+	nodes, err := node.FetchSNodeList(context.Background())
+	if err != nil {
+		t.Fatalf("fetch snode list failed: %s", err.Error())
+	}
+	if len(nodes) != 6 {
+		t.Fatalf("expected 6 nodes, got %d", len(nodes))
+	}
+}
+
+func TestStoreAndFetch(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 3)
+	defer net.Close()
+
+	node := net.Seed()
+	_, err := node.StoreMessage(context.Background(), testPubkey, model.Message{Raw: []byte("first")})
+	if err != nil {
+		t.Fatalf("store failed: %s", err.Error())
+	}
+	_, err = node.StoreMessage(context.Background(), testPubkey, model.Message{Raw: []byte("second")})
+	if err != nil {
+		t.Fatalf("store failed: %s", err.Error())
+	}
+	msgs, err := node.FetchMessages(context.Background(), testPubkey, "")
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if !bytes.Equal(msgs[0].Raw, []byte("first")) {
+		t.Fatalf("unexpected message data: %q", msgs[0].Raw)
+	}
+	if msgs[0].Timestamp == "" || msgs[0].Hash == "" {
+		t.Fatalf("message missing hash or timestamp: %+v", msgs[0])
+	}
+
+	msgs, err = node.FetchMessages(context.Background(), testPubkey, msgs[0].Hash)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Raw, []byte("second")) {
+		t.Fatalf("lastHash not honoured, got %d messages", len(msgs))
+	}
+}
+
+func TestStoreTTL(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 3)
+	defer net.Close()
+
+	node := net.Seed()
+	_, err := node.StoreMessage(context.Background(), testPubkey, model.Message{Raw: []byte("kept")})
+	if err != nil {
+		t.Fatalf("store failed: %s", err.Error())
+	}
+	msgs := net.Messages(testPubkey)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 stored message, got %d", len(msgs))
+	}
+	// the storage server reads the ttl in milliseconds
+	if ttl := time.Duration(msgs[0].Expiration-msgs[0].Timestamp) * time.Millisecond; ttl != 14*24*time.Hour {
+		t.Fatalf("message stored for %s", ttl)
+	}
+}
+
+func TestRedirectToSwarm(t *testing.T) {
+	net := swarmtest.NewNetwork(4, 2)
+	defer net.Close()
+
+	ourSwarm := net.SwarmFor(testPubkey)
+	var outsider *swarmtest.Node
+	for idx := range net.Nodes() {
+		node := net.Node(idx)
+		inSwarm := false
+		for _, member := range ourSwarm {
+			if member.IdentityKey == node.Info().IdentityKey {
+				inSwarm = true
+			}
+		}
+		if !inSwarm {
+			outsider = node
+			break
+		}
+	}
+	if outsider == nil {
+		t.Fatal("every node is in our swarm")
+	}
+	info := outsider.Info()
+	stored, err := info.StoreMessage(context.Background(), testPubkey, model.Message{Raw: []byte("redirected")})
+	if err != nil {
+		t.Fatalf("store failed: %s", err.Error())
+	}
+	if stored.IdentityKey == info.IdentityKey {
+		t.Fatal("store was not redirected")
+	}
+	if len(net.Messages(testPubkey)) != 1 {
+		t.Fatal("message was not stored")
+	}
+	msgs, err := info.FetchMessages(context.Background(), testPubkey, "")
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+}
+
+func TestOnionRequest(t *testing.T) {
+	net := swarmtest.NewNetwork(2, 3)
+	defer net.Close()
+
+	target := net.SwarmFor(testPubkey)[0]
+	var path swarm.Path
+	var guard *swarmtest.Node
+	for idx := range net.Nodes() {
+		node := net.Node(idx)
+		if node.Info().IdentityKey == target.IdentityKey {
+			continue
+		}
+		if guard == nil {
+			guard = node
+		}
+		path = append(path, node.Info())
+		if len(path) == 3 {
+			break
+		}
+	}
+	node := target.Through(path)
+	_, err := node.StoreMessage(context.Background(), testPubkey, model.Message{Raw: []byte("onion")})
+	if err != nil {
+		t.Fatalf("store failed: %s", err.Error())
+	}
+	msgs, err := node.FetchMessages(context.Background(), testPubkey, "")
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Raw, []byte("onion")) {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	if guard.Requests() == 0 {
+		t.Fatal("request did not go through the guard")
+	}
+
+	broken := append(swarm.Path{}, path...)
+	broken[1].IdentityKey = target.EncryptionKey
+	node = target.Through(broken)
+	_, err = node.FetchMessages(context.Background(), testPubkey, "")
+	if !errors.Is(err, rpc.ErrPathFailed) {
+		t.Fatalf("expected ErrPathFailed, got %v", err)
+	}
+}
+
+type fakeTransport struct {
+	storage rpc.RPC
+}
+
+func (t *fakeTransport) Storage(node *swarm.ServiceNode) rpc.RPC {
+	return t.storage
+}
+
+func (t *fakeTransport) JSONRPC(node *swarm.ServiceNode) rpc.RPC {
+	return t.storage
+}
+
+func TestFakeTransport(t *testing.T) {
+	var gotMethod string
+	node := swarm.ServiceNode{}.Using(&fakeTransport{
+		storage: rpc.Func(func(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+			gotMethod = method
+			return json.RawMessage(`{"messages": [{"hash": "h", "data": "ZmFrZQ==", "timestamp": 1}]}`), nil
+		}),
+	})
+	msgs, err := node.FetchMessages(context.Background(), testPubkey, "")
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err.Error())
+	}
+	if gotMethod != "retrieve" {
+		t.Fatalf("unexpected method %q", gotMethod)
+	}
+	if len(msgs) != 1 || string(msgs[0].Raw) != "fake" || msgs[0].Timestamp != "1" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	addr := hung.Listener.Addr().(*net.TCPAddr)
+	node := swarm.ServiceNode{RemoteIP: addr.IP.String(), StoragePort: addr.Port}
+	node = node.Using(&swarm.DirectTransport{InsecureSkipVerify: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	_, err := node.FetchMessages(ctx, testPubkey, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Fatalf("fetch ignored the deadline, took %s", time.Since(started))
+	}
+}
+
+func TestCertificatePinning(t *testing.T) {
+	net := swarmtest.NewNetwork(1, 2)
+	defer net.Close()
+
+	pinned := swarm.DirectTransport{PinIdentities: true, Pins: rpc.NewPinner(nil)}
+	genuine := net.Node(1).Info().Using(&pinned)
+	_, err := genuine.FetchMessages(context.Background(), testPubkey, "")
+	if err != nil {
+		t.Fatalf("pinned fetch failed: %s", err.Error())
+	}
+	impostor := net.Node(0).Info()
+	impostor.IdentityKey = net.Node(1).Info().IdentityKey
+	pinnedImpostor := impostor.Using(&pinned)
+	_, err = pinnedImpostor.FetchMessages(context.Background(), testPubkey, "")
+	if !errors.Is(err, rpc.ErrCertificate) {
+		t.Fatalf("expected certificate error, got %v", err)
+	}
+	// pinning is opt in, oxen storage servers do not sign their certificates
+	_, err = impostor.FetchMessages(context.Background(), testPubkey, "")
+	if err != nil {
+		t.Fatalf("unpinned fetch failed: %s", err.Error())
+	}
+
+	anonymous := net.Node(0).Info()
+	anonymous.IdentityKey = ""
+	_, err = anonymous.FetchMessages(context.Background(), testPubkey, "")
+	if !errors.Is(err, rpc.ErrCertificate) {
+		t.Fatalf("expected certificate error for node without identity key, got %v", err)
+	}
+	insecure := anonymous.Using(&swarm.DirectTransport{InsecureSkipVerify: true})
+	_, err = insecure.FetchMessages(context.Background(), testPubkey, "")
+	if err != nil {
+		t.Fatalf("insecure fetch failed: %s", err.Error())
+	}
+
+	path := swarm.Path{impostor}
+	onion := net.Node(1).Info().Using(&swarm.OnionTransport{Path: path, DirectTransport: pinned})
+	_, err = onion.FetchMessages(context.Background(), testPubkey, "")
+	if !errors.Is(err, rpc.ErrCertificate) || !errors.Is(err, rpc.ErrPathFailed) {
+		t.Fatalf("expected certificate error from guard, got %v", err)
+	}
+}
@@ -0,0 +1,536 @@
+/// Package swarmtest runs an in-process fake of the storage server network so
+/// swarm and client code can be exercised without touching the real network.
+package swarmtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/majestrate/ubw/lib/cryptography"
+	"github.com/majestrate/ubw/lib/swarm"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/// StoredMessage is a message held in a fake mailbox
+type StoredMessage struct {
+	Hash       string
+	Data       []byte
+	Timestamp  int64
+	Expiration int64
+}
+
+type mailbox struct {
+	msgs []StoredMessage
+}
+
+/// Network is a set of fake service nodes sharing one view of the mailboxes
+type Network struct {
+	mtx       sync.Mutex
+	nodes     []*Node
+	mailboxes map[string]*mailbox
+	now       func() time.Time
+	/// infoMtx guards node info, which changes when a node moves swarm
+	infoMtx sync.RWMutex
+}
+
+/// Node is a single fake service node backed by an httptest TLS server
+type Node struct {
+	net         *Network
+	info        swarm.ServiceNode
+	identity    ed25519.PrivateKey
+	encryption  [32]byte
+	srv         *httptest.Server
+	requests    int
+	conns       int
+	signature   string
+	seed        bool
+	requestsMtx sync.Mutex
+}
+
+/// NewNetwork starts numSwarms swarms of nodesPerSwarm fake service nodes each
+func NewNetwork(numSwarms, nodesPerSwarm int) *Network {
+	n := &Network{
+		mailboxes: make(map[string]*mailbox),
+		now:       time.Now,
+	}
+	step := uint64(math.MaxUint64) / uint64(numSwarms)
+	for s := 0; s < numSwarms; s++ {
+		for i := 0; i < nodesPerSwarm; i++ {
+			n.nodes = append(n.nodes, n.newNode(uint64(s)*step))
+		}
+	}
+	n.nodes[0].seed = true
+	return n
+}
+
+func (n *Network) newNode(swarmID uint64) *Node {
+	node := &Node{net: n}
+	pub, sec, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	node.identity = sec
+	_, err = rand.Read(node.encryption[:])
+	if err != nil {
+		panic(err)
+	}
+	xpub, err := curve25519.X25519(node.encryption[:], curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json_rpc", node.serveJSONRPC)
+	mux.HandleFunc("/storage_rpc/v1", node.serveStorageRPC)
+	mux.HandleFunc("/onion_req/v2", node.serveOnion)
+	node.srv = httptest.NewUnstartedServer(node.signResponses(mux))
+	node.srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			node.requestsMtx.Lock()
+			node.conns++
+			node.requestsMtx.Unlock()
+		}
+	}
+	// every httptest server shares one certificate, real nodes each have their own
+	node.srv.TLS = &tls.Config{Certificates: []tls.Certificate{selfSigned()}}
+	node.srv.StartTLS()
+	node.signature = rpc.CertificateSignature(node.identity, node.srv.Certificate().Raw)
+
+	host, port, _ := net.SplitHostPort(node.srv.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	node.info = swarm.ServiceNode{
+		RemoteIP:      host,
+		StoragePort:   portNum,
+		IdentityKey:   hex.EncodeToString(pub),
+		EncryptionKey: hex.EncodeToString(xpub),
+		SwarmID:       swarmID,
+	}
+	return node
+}
+
+/// selfSigned makes a fresh self signed certificate for a node on localhost
+func selfSigned() tls.Certificate {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+/// SetClock overrides the time source used for timestamps and expiry
+func (n *Network) SetClock(now func() time.Time) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.now = now
+}
+
+/// Nodes returns the service node info of every node in the network
+func (n *Network) Nodes() (nodes []swarm.ServiceNode) {
+	n.infoMtx.RLock()
+	defer n.infoMtx.RUnlock()
+	for _, node := range n.nodes {
+		nodes = append(nodes, node.info)
+	}
+	return
+}
+
+/// Len returns the number of nodes in the network
+func (n *Network) Len() int {
+	return len(n.nodes)
+}
+
+/// Node returns the idx'th fake node
+func (n *Network) Node(idx int) *Node {
+	return n.nodes[idx]
+}
+
+/// Seed returns a node suitable for use as a seed node
+func (n *Network) Seed() swarm.ServiceNode {
+	return n.nodes[0].Info()
+}
+
+/// SwarmFor returns the nodes responsible for a pubkey
+func (n *Network) SwarmFor(pubkey string) []swarm.ServiceNode {
+	return swarm.GetSwarmForPubkey(n.Nodes(), stripPrefix(pubkey))
+}
+
+/// Messages returns the unexpired messages held for a pubkey
+func (n *Network) Messages(pubkey string) []StoredMessage {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.unexpired(pubkey)
+}
+
+/// Close shuts down every node in the network
+func (n *Network) Close() {
+	for _, node := range n.nodes {
+		node.srv.Close()
+	}
+}
+
+/// Close shuts down this node so requests to it fail
+func (node *Node) Close() {
+	node.srv.Close()
+}
+
+/// Info returns the service node info for this node
+func (node *Node) Info() swarm.ServiceNode {
+	node.net.infoMtx.RLock()
+	defer node.net.infoMtx.RUnlock()
+	return node.info
+}
+
+/// SetSwarm moves this node into another swarm, its mailboxes stay shared with the rest of the network
+func (node *Node) SetSwarm(swarmID uint64) {
+	node.net.infoMtx.Lock()
+	defer node.net.infoMtx.Unlock()
+	node.info.SwarmID = swarmID
+}
+
+/// Requests returns how many requests this node has served
+func (node *Node) Requests() int {
+	node.requestsMtx.Lock()
+	defer node.requestsMtx.Unlock()
+	return node.requests
+}
+
+/// Connections returns how many connections have been opened to this node
+func (node *Node) Connections() int {
+	node.requestsMtx.Lock()
+	defer node.requestsMtx.Unlock()
+	return node.conns
+}
+
+func stripPrefix(pubkey string) string {
+	if len(pubkey) == 66 {
+		return pubkey[2:]
+	}
+	return pubkey
+}
+
+func (n *Network) unexpired(pubkey string) (msgs []StoredMessage) {
+	box, ok := n.mailboxes[pubkey]
+	if !ok {
+		return
+	}
+	now := n.now().UnixNano() / int64(time.Millisecond)
+	for _, msg := range box.msgs {
+		if msg.Expiration > now {
+			msgs = append(msgs, msg)
+		}
+	}
+	return
+}
+
+func (node *Node) inSwarm(pubkey string) bool {
+	for _, peer := range node.net.SwarmFor(pubkey) {
+		if peer.IdentityKey == node.info.IdentityKey {
+			return true
+		}
+	}
+	return false
+}
+
+/// signResponses adds the header binding our certificate to our identity key to every response like the storage server does
+func (node *Node) signResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(rpc.SignatureHeader, node.signature)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (node *Node) countRequest() {
+	node.requestsMtx.Lock()
+	node.requests++
+	node.requestsMtx.Unlock()
+}
+
+type jsonRequest struct {
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func (node *Node) readRequest(w http.ResponseWriter, r *http.Request) (req jsonRequest, ok bool) {
+	node.countRequest()
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid json: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	ok = true
+	return
+}
+
+func (node *Node) serveJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if !node.seed {
+		// storage servers do not serve the oxend json rpc, only seeds do
+		http.NotFound(w, r)
+		return
+	}
+	req, ok := node.readRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Method != "get_n_service_nodes" {
+		http.Error(w, fmt.Sprintf("unknown method %s", req.Method), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"result": map[string]interface{}{
+			"service_node_states": node.net.Nodes(),
+		},
+	})
+}
+
+func (node *Node) serveStorageRPC(w http.ResponseWriter, r *http.Request) {
+	req, ok := node.readRequest(w, r)
+	if !ok {
+		return
+	}
+	var code int
+	var result interface{}
+	if req.Method == "oxend_request" {
+		code, result = node.handleOxendRequest(req.Params)
+	} else {
+		code, result = node.handleStorage(req.Method, req.Params)
+	}
+	if result == nil {
+		w.WriteHeader(code)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+/// handleOxendRequest answers the oxend requests a storage server passes on, only get_service_nodes is supported
+func (node *Node) handleOxendRequest(params map[string]interface{}) (int, interface{}) {
+	if endpoint, _ := params["endpoint"].(string); endpoint != "get_service_nodes" {
+		return http.StatusBadRequest, map[string]interface{}{"error": fmt.Sprintf("unsupported oxend endpoint %v", params["endpoint"])}
+	}
+	return http.StatusOK, map[string]interface{}{
+		"result": map[string]interface{}{
+			"service_node_states": node.net.Nodes(),
+		},
+	}
+}
+
+func (node *Node) handleStorage(method string, params map[string]interface{}) (int, interface{}) {
+	pubkey, _ := params["pubKey"].(string)
+	if pubkey == "" {
+		return http.StatusBadRequest, map[string]interface{}{"error": "missing pubKey"}
+	}
+	if !node.inSwarm(pubkey) {
+		return http.StatusMisdirectedRequest, node.net.redirectFor(pubkey)
+	}
+	switch method {
+	case "store":
+		return node.net.store(pubkey, params)
+	case "retrieve":
+		lastHash, _ := params["lastHash"].(string)
+		return http.StatusOK, node.net.retrieve(pubkey, lastHash)
+	}
+	return http.StatusBadRequest, map[string]interface{}{"error": fmt.Sprintf("unknown method %s", method)}
+}
+
+func (n *Network) redirectFor(pubkey string) map[string]interface{} {
+	var snodes []map[string]interface{}
+	for _, node := range n.SwarmFor(pubkey) {
+		snodes = append(snodes, map[string]interface{}{
+			"ip":             node.RemoteIP,
+			"port":           fmt.Sprintf("%d", node.StoragePort),
+			"pubkey_ed25519": node.IdentityKey,
+			"pubkey_x25519":  node.EncryptionKey,
+		})
+	}
+	return map[string]interface{}{"snodes": snodes}
+}
+
+func (n *Network) store(pubkey string, params map[string]interface{}) (int, interface{}) {
+	ttlStr, _ := params["ttl"].(string)
+	tsStr, _ := params["timestamp"].(string)
+	dataStr, _ := params["data"].(string)
+	ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+	if err != nil || ttl <= 0 {
+		return http.StatusBadRequest, map[string]interface{}{"error": "invalid ttl"}
+	}
+	timestamp, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, map[string]interface{}{"error": "invalid timestamp"}
+	}
+	data, err := base64.StdEncoding.DecodeString(dataStr)
+	if err != nil {
+		return http.StatusBadRequest, map[string]interface{}{"error": "invalid data"}
+	}
+	h, _ := blake2b.New256(nil)
+	fmt.Fprintf(h, "%d%d%s", timestamp, ttl, pubkey)
+	h.Write(data)
+	msg := StoredMessage{
+		Hash:       base64.RawStdEncoding.EncodeToString(h.Sum(nil)),
+		Data:       data,
+		Timestamp:  timestamp,
+		Expiration: timestamp + ttl,
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	box, ok := n.mailboxes[pubkey]
+	if !ok {
+		box = new(mailbox)
+		n.mailboxes[pubkey] = box
+	}
+	for _, existing := range box.msgs {
+		if existing.Hash == msg.Hash {
+			return http.StatusOK, map[string]interface{}{"hash": msg.Hash, "difficulty": 1}
+		}
+	}
+	box.msgs = append(box.msgs, msg)
+	return http.StatusOK, map[string]interface{}{"hash": msg.Hash, "difficulty": 1}
+}
+
+func (n *Network) retrieve(pubkey, lastHash string) map[string]interface{} {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	msgs := n.unexpired(pubkey)
+	for idx, msg := range msgs {
+		if msg.Hash == lastHash {
+			msgs = msgs[idx+1:]
+			break
+		}
+	}
+	list := make([]map[string]interface{}, 0, len(msgs))
+	for _, msg := range msgs {
+		list = append(list, map[string]interface{}{
+			"hash":       msg.Hash,
+			"data":       base64.StdEncoding.EncodeToString(msg.Data),
+			"timestamp":  msg.Timestamp,
+			"expiration": msg.Expiration,
+		})
+	}
+	return map[string]interface{}{"messages": list}
+}
+
+func (n *Network) nodeByKey(identityKey string) *Node {
+	for _, node := range n.nodes {
+		if node.info.IdentityKey == identityKey {
+			return node
+		}
+	}
+	return nil
+}
+
+func (node *Node) serveOnion(w http.ResponseWriter, r *http.Request) {
+	node.countRequest()
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code, body := node.processOnion(payload)
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+/// processOnion peels one layer off an onion request, relaying it onwards or answering it if we are the destination
+func (node *Node) processOnion(payload []byte) (int, []byte) {
+	ciphertext, meta, err := rpc.DecodeOnionPayload(payload)
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	ephemeral, err := hex.DecodeString(fmt.Sprintf("%s", meta["ephemeral_key"]))
+	if err != nil {
+		return http.StatusBadRequest, []byte("invalid ephemeral key")
+	}
+	key, err := cryptography.DeriveSymmetricKey(node.encryption[:], ephemeral)
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	plain, err := cryptography.DecryptGCM(key, ciphertext)
+	if err != nil {
+		return http.StatusBadRequest, []byte("decryption failed")
+	}
+	if len(plain) > 0 && plain[0] == '{' {
+		return node.answerOnion(key, plain)
+	}
+	inner, innerMeta, err := rpc.DecodeOnionPayload(plain)
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	next := node.net.nodeByKey(fmt.Sprintf("%s", innerMeta["destination"]))
+	if next == nil {
+		return http.StatusBadGateway, []byte("Next node not found")
+	}
+	relayed, err := rpc.EncodeOnionPayload(inner, map[string]interface{}{
+		"ephemeral_key": innerMeta["ephemeral_key"],
+		"enc_type":      innerMeta["enc_type"],
+	})
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	next.countRequest()
+	return next.processOnion(relayed)
+}
+
+func (node *Node) answerOnion(key, plain []byte) (int, []byte) {
+	var req jsonRequest
+	err := json.Unmarshal(plain, &req)
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	var code int
+	var result interface{}
+	if req.Method == "oxend_request" {
+		code, result = node.handleOxendRequest(req.Params)
+	} else {
+		code, result = node.handleStorage(req.Method, req.Params)
+	}
+	var body []byte
+	if result != nil {
+		body, _ = json.Marshal(result)
+	}
+	resp, _ := json.Marshal(map[string]interface{}{
+		"body":   string(body),
+		"status": code,
+	})
+	ct, err := cryptography.EncryptGCM(key, resp)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return http.StatusOK, []byte(base64.StdEncoding.EncodeToString(ct))
+}
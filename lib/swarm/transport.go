@@ -0,0 +1,123 @@
+package swarm
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/majestrate/ubw/lib/swarm/rpc"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+/// Transport makes the rpc clients used to talk to a service node
+type Transport interface {
+	/// Storage returns an RPC for the node's storage server
+	Storage(node *ServiceNode) rpc.RPC
+	/// JSONRPC returns an RPC for the node's oxend json rpc endpoint
+	JSONRPC(node *ServiceNode) rpc.RPC
+}
+
+/// DefaultTransport is used by service nodes that have no transport set
+var DefaultTransport Transport = &DirectTransport{}
+
+/// DirectTransport talks to service nodes directly over https
+/// nodes reached by hostname without an identity key (seed nodes) must present a CA signed certificate,
+/// nodes with one must prove their self signed certificate belongs to it if PinIdentities is set
+type DirectTransport struct {
+	/// Client is the shared http client for service nodes, defaults to rpc.DefaultClient
+	Client *http.Client
+	/// CAClient is the shared CA verifying http client for seed nodes, defaults to rpc.DefaultCAClient
+	CAClient *http.Client
+	/// PinIdentities checks the certificate of nodes with an identity key against it, see rpc.Pinner for which networks support this
+	PinIdentities bool
+	/// Pins pins certificates when PinIdentities is set, defaults to rpc.DefaultPinner
+	Pins *rpc.Pinner
+	/// InsecureSkipVerify allows talking to nodes that have neither an identity key nor a hostname, only use this on private devnets
+	InsecureSkipVerify bool
+	Middleware         []rpc.Middleware
+}
+
+func (t *DirectTransport) endpoint(node *ServiceNode, u *url.URL) rpc.RPC {
+	h := &rpc.HTTPS{URL: u, Client: t.Client}
+	switch {
+	case node.IdentityKey != "":
+		h.IdentityKey = node.IdentityKey
+		h.Pins = t.pins()
+	case net.ParseIP(node.RemoteIP) == nil:
+		h.Client = t.CAClient
+		if h.Client == nil {
+			h.Client = rpc.DefaultCAClient
+		}
+	case !t.InsecureSkipVerify:
+		return rpc.Func(func(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+			return nil, &rpc.CertificateError{Host: u.Host, Reason: "no identity key to verify against"}
+		})
+	}
+	return rpc.Chain(h, t.Middleware...)
+}
+
+/// pins returns the Pinner to use, nil unless PinIdentities is set
+func (t *DirectTransport) pins() *rpc.Pinner {
+	if !t.PinIdentities {
+		return nil
+	}
+	if t.Pins == nil {
+		return rpc.DefaultPinner
+	}
+	return t.Pins
+}
+
+func (t *DirectTransport) Storage(node *ServiceNode) rpc.RPC {
+	return t.endpoint(node, node.StorageURL())
+}
+
+func (t *DirectTransport) JSONRPC(node *ServiceNode) rpc.RPC {
+	return t.endpoint(node, node.RPCURL())
+}
+
+/// Path is a list of service nodes an onion request is relayed through, the first node is the guard
+type Path []ServiceNode
+
+func (p Path) hops() (hops []rpc.Hop) {
+	for idx := range p {
+		hops = append(hops, p[idx].hop())
+	}
+	return
+}
+
+/// OnionTransport sends storage requests through an onion path, json rpc requests are not supported by onion requests and go direct
+type OnionTransport struct {
+	Path Path
+	DirectTransport
+}
+
+func (t *OnionTransport) Storage(node *ServiceNode) rpc.RPC {
+	return rpc.Chain(&rpc.Onion{Path: t.Path.hops(), Target: node.hop(), Client: t.Client, Pins: t.pins()}, t.Middleware...)
+}
+
+func (node *ServiceNode) hop() rpc.Hop {
+	return rpc.Hop{
+		Address:       net.JoinHostPort(node.SNodeAddr(), strconv.Itoa(node.StoragePort)),
+		IdentityKey:   node.IdentityKey,
+		EncryptionKey: node.EncryptionKey,
+	}
+}
+
+/// Using returns a copy of node that makes its requests with t
+func (node ServiceNode) Using(t Transport) ServiceNode {
+	node.transport = t
+	return node
+}
+
+/// Through returns a copy of node that sends its storage requests through path
+func (node ServiceNode) Through(path Path) ServiceNode {
+	return node.Using(&OnionTransport{Path: path})
+}
+
+func (node *ServiceNode) getTransport() Transport {
+	if node.transport == nil {
+		return DefaultTransport
+	}
+	return node.transport
+}